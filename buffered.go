@@ -23,6 +23,10 @@ import (
 //   * fluent.WithWriteQueueSize
 //
 // Please see their respective documentation for details.
+//
+// If any of the options have values of the wrong type or out of range,
+// or are not applicable to a buffered client, an *OptionError listing
+// all of them is returned.
 func NewBuffered(options ...Option) (client *Buffered, err error) {
 	if pdebug.Enabled {
 		g := pdebug.Marker("fluent.NewBuffered").BindError(&err)
@@ -43,9 +47,17 @@ func NewBuffered(options ...Option) (client *Buffered, err error) {
 			subsecond = opt.Value().(bool)
 		}
 	}
+	c.clock = m.clock
 	c.minionDone = m.done
+	c.minionFailing = m.failing
 	c.minionQueue = m.incoming
 	c.minionCancel = cancel
+	c.minionCloseHTTP = m.closeHTTP
+	c.minionStats = m.stats
+	c.minionUsage = m.usage
+	c.minionUndelivered = m.undelivered
+	c.filters = m.filters
+	c.limiter = m.limiter
 	c.pingQueue = m.pingCh
 	c.httpQueue = m.httpCh
 
@@ -53,11 +65,14 @@ func NewBuffered(options ...Option) (client *Buffered, err error) {
 	c.method = m.method
 
 	go m.runReader(ctx)
+	c.limiter.start(func(tag string, v interface{}) error {
+		return c.Post(tag, v)
+	})
 
 	if c.method == "http" {
 		go m.runHTTPWriter(ctx)
 	} else {
-		go m.runWriter(ctx)
+		go m.runWriters(ctx)
 	}
 
 	return &c, nil
@@ -67,6 +82,9 @@ func NewBuffered(options ...Option) (client *Buffered, err error) {
 //
 // An error is returned if the client has already been closed.
 //
+// Records discarded by WithRateLimit, WithSampling or one of the
+// filters given to WithFilters are not reported as errors.
+//
 // If you would like to specify options to `Post()`, you may pass them at the end of
 // the method. Currently you can use the following:
 //
@@ -86,6 +104,17 @@ func (c *Buffered) Post(tag string, v interface{}, options ...Option) (err error
 		g := pdebug.Marker("fluent.Buffered.Post").BindError(&err)
 		defer g.End()
 	}
+	return c.post(tag, v, nil, options)
+}
+
+// post implements Post and PostAsync. d is nil for Post
+func (c *Buffered) post(tag string, v interface{}, d *Delivery, options []Option) error {
+	if !c.limiter.allow(tag) {
+		if d != nil {
+			d.advance(deliveryAcked)
+		}
+		return nil
+	}
 	if c.method == "http" {
 		return c.HttpPost(tag, v, options...)
 	}
@@ -107,7 +136,8 @@ func (c *Buffered) Post(tag string, v interface{}, options ...Option) (err error
 		case optkeyTimestamp:
 			t = opt.Value().(time.Time)
 		case optkeySyncAppend:
-			syncAppend = opt.Value().(bool)
+			// PostAsync reports the append through the Delivery
+			syncAppend = d == nil && opt.Value().(bool)
 		case optkeySubSecond:
 			subsecond = opt.Value().(bool)
 		case optkeyContext:
@@ -118,10 +148,23 @@ func (c *Buffered) Post(tag string, v interface{}, options ...Option) (err error
 		}
 	}
 	if t.IsZero() {
-		t = time.Now()
+		t = c.clock.Now()
+	}
+
+	tag, t, v, ok := applyFilters(c.filters, tag, t, v)
+	if !ok {
+		if d != nil {
+			d.advance(deliveryAcked)
+		}
+		return nil
 	}
 
 	msg := makeMessage(tag, v, t, subsecond, syncAppend)
+	if d != nil {
+		// ask the server to acknowledge the record
+		msg.Option = map[string]interface{}{"chunk": d.id}
+		msg.delivery = d
+	}
 
 	// This has to be separate from msg.replyCh, b/c msg would be
 	// put back to the pool
@@ -179,6 +222,8 @@ func (c *Buffered) Post(tag string, v interface{}, options ...Option) (err error
 // to be flushed. If you want to make sure that background minion has properly
 // exited, you should probably use the Shutdown() method
 func (c *Buffered) Close() error {
+	c.limiter.stop()
+
 	c.muClosed.Lock()
 	c.closed = true
 	if c.minionQueue != nil {
@@ -190,7 +235,7 @@ func (c *Buffered) Close() error {
 		c.pingQueue = nil
 	}
 	if c.httpQueue != nil {
-		close(c.httpQueue)
+		c.minionCloseHTTP()
 		c.httpQueue = nil
 	}
 
@@ -203,6 +248,10 @@ func (c *Buffered) Close() error {
 // Shutdown closes the connection, and notifies the background worker to
 // flush all existing buffers. This method will block until the
 // background minion exits, or the provided context object is canceled.
+//
+// If any records could not be delivered, an *UndeliveredError with
+// their counts is returned. When the context is canceled first, its
+// error is available from the Err field (and errors.Is).
 func (c *Buffered) Shutdown(ctx context.Context) error {
 	if pdebug.Enabled {
 		pdebug.Printf("client: shutdown requested")
@@ -219,8 +268,15 @@ func (c *Buffered) Shutdown(ctx context.Context) error {
 
 	select {
 	case <-ctx.Done():
+		if e := c.minionUndelivered(); e != nil {
+			e.Err = ctx.Err()
+			return e
+		}
 		return ctx.Err()
 	case <-c.minionDone:
+		if e := c.minionUndelivered(); e != nil {
+			return e
+		}
 		return nil
 	}
 }
@@ -251,7 +307,7 @@ func (c *Buffered) Ping(tag string, record interface{}, options ...Option) (err
 		}
 	}
 	if t.IsZero() {
-		t = time.Now()
+		t = c.clock.Now()
 	}
 
 	msg := makeMessage(tag, record, t, subsecond, true)
@@ -312,7 +368,12 @@ func (c *Buffered) HttpPost(tag string, record interface{}, options ...Option) (
 		}
 	}
 	if t.IsZero() {
-		t = time.Now()
+		t = c.clock.Now()
+	}
+
+	tag, t, record, ok := applyFilters(c.filters, tag, t, record)
+	if !ok {
+		return nil
 	}
 
 	msg := makeMessage(tag, record, t, subsecond, syncAppend)
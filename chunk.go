@@ -0,0 +1,492 @@
+package fluent
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pdebug "github.com/lestrrat-go/pdebug"
+	"github.com/pkg/errors"
+)
+
+// WithChunkSizeLimit specifies the maximum size of a buffer chunk.
+// Records are grouped in chunks by tag, and chunks are the unit in
+// which the background writer flushes (and retries) data. The value may
+// be an int (number of bytes), or a string such as "512KB" or "1MB".
+// The default value is 1MB
+func WithChunkSizeLimit(size interface{}) Option {
+	return &option{
+		name:  optkeyChunkSizeLimit,
+		value: size,
+	}
+}
+
+// WithChunkLimit specifies the maximum number of buffer chunks. When
+// the limit is reached, new records for tags that do not have a chunk
+// with room left are rejected as if the buffer were full. The limit is
+// divided evenly between the writers (see WithWriterConcurrency).
+// The default value is 0, which means that only the buffer limit applies
+func WithChunkLimit(n int) Option {
+	return &option{
+		name:  optkeyChunkLimit,
+		value: n,
+	}
+}
+
+// maxFreeChunks is the number of chunk buffers each lane keeps for reuse
+const maxFreeChunks = 4
+
+// chunk is a group of serialized records sharing the same tag
+type chunk struct {
+	id      uint64
+	tag     string
+	class   int
+	records int
+	created time.Time
+	retries int
+	buf     []byte
+	// deliveries tracks the records posted with PostAsync
+	deliveries []*Delivery
+}
+
+// lane is a pending buffer, drained by its own writer goroutine over
+// its own connection. There is one lane per writer (see WithWriterConcurrency)
+//
+// The reader appends records to an open chunk for their tag. When the
+// writer is ready to write, the open chunks are queued, and the writer
+// takes ownership of the oldest queued chunk with the highest priority,
+// writing it without holding muPending. This way a slow network write
+// never blocks the reader.
+//
+// Each chunk belongs to a buffer class (see WithTagBuffer), which has its
+// own limit, priority and overflow policy.
+type lane struct {
+	id         int
+	limit      int
+	chunkSize  int
+	chunkLimit int
+	chunkIDs   *uint64
+	clock      Clock
+	cond       *sync.Cond
+	muPending  sync.RWMutex
+	open       map[string]*chunk
+	queue      []*chunk
+	flushing   *chunk
+	offset     int
+	bytes      int
+	records    int
+	chunks     int
+	classes    []laneClass
+	free       [][]byte
+	awaited    int // records posted with PostAsync in the lane
+}
+
+// laneClass is the state of a buffer class within a lane
+type laneClass struct {
+	limit    int
+	priority int
+	overflow OverflowPolicy
+	maxAge   time.Duration
+	bytes    int
+	dropped  int
+	expired  int
+}
+
+func newLane(id, limit, chunkSize, chunkLimit int, chunkIDs *uint64, classes []laneClass, clock Clock) *lane {
+	return &lane{
+		id:         id,
+		clock:      clock,
+		limit:      limit,
+		chunkSize:  chunkSize,
+		chunkLimit: chunkLimit,
+		chunkIDs:   chunkIDs,
+		classes:    classes,
+		cond:       sync.NewCond(&sync.Mutex{}),
+		open:       make(map[string]*chunk),
+	}
+}
+
+// append adds a serialized record to the open chunk for tag, which
+// belongs to the given buffer class. d is non-nil for records posted with
+// PostAsync. Returns false if the buffer is full
+func (l *lane) append(tag string, class int, buf []byte, d *Delivery) bool {
+	l.muPending.Lock()
+	defer l.muPending.Unlock()
+
+	cl := &l.classes[class]
+	for {
+		c := l.open[tag]
+		if c != nil && len(c.buf)+len(buf) > l.chunkSize {
+			l.enqueue(c)
+			c = nil
+		}
+
+		full := l.bytes+len(buf) > l.limit ||
+			(cl.limit > 0 && cl.bytes+len(buf) > cl.limit) ||
+			(c == nil && l.chunkLimit > 0 && l.chunks >= l.chunkLimit)
+		if !full {
+			if c == nil {
+				c = l.newChunk(tag, class)
+			}
+			c.buf = append(c.buf, buf...)
+			c.records++
+			l.records++
+			l.bytes += len(buf)
+			cl.bytes += len(buf)
+			if d != nil {
+				c.deliveries = append(c.deliveries, d)
+				l.awaited++
+			}
+			return true
+		}
+
+		if l.expire() > 0 {
+			continue
+		}
+		if cl.overflow != OverflowDropOldest || !l.dropOldest(class) {
+			return false
+		}
+	}
+}
+
+// dropOldest discards the oldest chunk of the given class, other than
+// the one being written. Returns false if there was nothing to discard.
+// Must be called with muPending held
+func (l *lane) dropOldest(class int) bool {
+	var oldest *chunk
+	queued := -1
+	for i, c := range l.queue {
+		if c.class == class && (oldest == nil || c.id < oldest.id) {
+			oldest, queued = c, i
+		}
+	}
+	for _, c := range l.open {
+		if c.class == class && (oldest == nil || c.id < oldest.id) {
+			oldest, queued = c, -1
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+
+	if queued >= 0 {
+		l.queue = append(l.queue[:queued], l.queue[queued+1:]...)
+	} else {
+		delete(l.open, oldest.tag)
+	}
+	if pdebug.Enabled {
+		pdebug.Printf("lane %d: buffer overflow, dropping chunk %d (tag %s, %d records)", l.id, oldest.id, oldest.tag, oldest.records)
+	}
+	l.classes[class].dropped += oldest.records
+	failDeliveries([]*chunk{oldest}, &bufferFullErrInstance)
+	l.discard(oldest, len(oldest.buf))
+	return true
+}
+
+// expire discards the chunks (other than the one being written) that
+// were created longer ago than the max record age of their class.
+// Returns the number of chunks discarded. Must be called with
+// muPending held
+func (l *lane) expire() int {
+	var n int
+	expired := func(c *chunk) bool {
+		maxAge := l.classes[c.class].maxAge
+		if maxAge <= 0 || l.clock.Now().Sub(c.created) < maxAge {
+			return false
+		}
+		if pdebug.Enabled {
+			pdebug.Printf("lane %d: chunk %d (tag %s, %d records) expired", l.id, c.id, c.tag, c.records)
+		}
+		l.classes[c.class].expired += c.records
+		failDeliveries([]*chunk{c}, errRecordExpired)
+		l.discard(c, len(c.buf))
+		n++
+		return true
+	}
+
+	queue := l.queue[:0]
+	for _, c := range l.queue {
+		if !expired(c) {
+			queue = append(queue, c)
+		}
+	}
+	for i := len(queue); i < len(l.queue); i++ {
+		l.queue[i] = nil
+	}
+	l.queue = queue
+
+	for tag, c := range l.open {
+		if expired(c) {
+			delete(l.open, tag)
+		}
+	}
+	return n
+}
+
+// discard removes a chunk that is no longer in the buffer, of which
+// remaining bytes had not been written. Must be called with muPending held
+func (l *lane) discard(c *chunk, remaining int) {
+	l.bytes -= remaining
+	l.records -= c.records
+	l.classes[c.class].bytes -= remaining
+	l.chunks--
+	l.awaited -= len(c.deliveries)
+	c.deliveries = nil
+	// keep some memory around for the next chunks
+	if cap(c.buf) <= l.chunkSize && len(l.free) < maxFreeChunks {
+		l.free = append(l.free, c.buf[:0])
+	}
+}
+
+// newChunk creates an open chunk for tag. Must be called with
+// muPending held
+func (l *lane) newChunk(tag string, class int) *chunk {
+	c := &chunk{
+		id:      atomic.AddUint64(l.chunkIDs, 1),
+		tag:     tag,
+		class:   class,
+		created: l.clock.Now(),
+	}
+	if n := len(l.free); n > 0 {
+		c.buf = l.free[n-1]
+		l.free = l.free[:n-1]
+	}
+	l.open[tag] = c
+	l.chunks++
+	return c
+}
+
+// enqueue closes an open chunk, and queues it for writing. Must be
+// called with muPending held
+func (l *lane) enqueue(c *chunk) {
+	if pdebug.Enabled {
+		pdebug.Printf("lane %d: queueing chunk %d (tag %s, %d records, %d bytes)", l.id, c.id, c.tag, c.records, len(c.buf))
+	}
+	delete(l.open, c.tag)
+	l.queue = append(l.queue, c)
+}
+
+// enqueueAll closes every open chunk, oldest first. Must be called
+// with muPending held
+func (l *lane) enqueueAll() {
+	if len(l.open) == 0 {
+		return
+	}
+	open := make([]*chunk, 0, len(l.open))
+	for _, c := range l.open {
+		open = append(open, c)
+	}
+	sort.Slice(open, func(i, j int) bool { return open[i].id < open[j].id })
+	for _, c := range open {
+		l.enqueue(c)
+	}
+}
+
+// drain removes every chunk from the lane, oldest first, and returns them
+func (l *lane) drain() []*chunk {
+	l.muPending.Lock()
+	defer l.muPending.Unlock()
+
+	l.enqueueAll()
+	chunks := l.queue
+	if l.flushing != nil {
+		chunks = append([]*chunk{l.flushing}, chunks...)
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].id < chunks[j].id })
+	// the chunks are handed over, so their memory is not reused
+	for _, c := range chunks {
+		l.bytes -= len(c.buf)
+		l.records -= c.records
+		l.classes[c.class].bytes -= len(c.buf)
+		l.chunks--
+		l.awaited -= len(c.deliveries)
+	}
+	l.queue = nil
+	l.flushing = nil
+	l.offset = 0
+	return chunks
+}
+
+// buffered returns the number of bytes waiting to be written. Must be
+// called with muPending held
+func (l *lane) buffered() int {
+	return l.bytes
+}
+
+// pending returns the number of records and bytes in the lane
+func (l *lane) pending() (int, int) {
+	l.muPending.RLock()
+	defer l.muPending.RUnlock()
+
+	return l.records, l.bytes
+}
+
+// usage adds the bytes and records in the lane to u
+func (l *lane) usage(u *bufferUsage) {
+	l.muPending.RLock()
+	defer l.muPending.RUnlock()
+
+	u.bytes += l.bytes
+	u.records += l.records
+}
+
+// take hands the oldest queued chunk with the highest priority over to
+// the writer, and returns the part of it that remains to be written,
+// along with the deliveries of its records. The open chunks are queued
+// first
+func (l *lane) take() ([]byte, []*Delivery) {
+	l.muPending.Lock()
+	defer l.muPending.Unlock()
+
+	// a chunk that failed to be written may have expired while we were
+	// trying to reconnect
+	if c := l.flushing; c != nil && l.offset == 0 {
+		if maxAge := l.classes[c.class].maxAge; maxAge > 0 && l.clock.Now().Sub(c.created) >= maxAge {
+			l.classes[c.class].expired += c.records
+			failDeliveries([]*chunk{c}, errRecordExpired)
+			l.discard(c, len(c.buf))
+			l.flushing = nil
+		}
+	}
+
+	if l.flushing == nil {
+		l.expire()
+		l.enqueueAll()
+		if len(l.queue) == 0 {
+			return nil, nil
+		}
+
+		// the queue is ordered by age, so the first chunk we find with
+		// the highest priority is the one to write
+		next := 0
+		for i, c := range l.queue {
+			if l.classes[c.class].priority > l.classes[l.queue[next].class].priority {
+				next = i
+			}
+		}
+		l.flushing = l.queue[next]
+		l.queue = append(l.queue[:next], l.queue[next+1:]...)
+		l.offset = 0
+	}
+	return l.flushing.buf[l.offset:], l.flushing.deliveries
+}
+
+// written records that n bytes returned by take have been written.
+// Once the whole chunk has been written, it is discarded
+func (l *lane) written(n int) {
+	l.muPending.Lock()
+	defer l.muPending.Unlock()
+
+	c := l.flushing
+	l.offset += n
+	if l.offset >= len(c.buf) {
+		if pdebug.Enabled {
+			pdebug.Printf("lane %d: chunk %d written", l.id, c.id)
+		}
+		for _, d := range c.deliveries {
+			d.advance(deliveryWritten)
+		}
+		l.discard(c, len(c.buf))
+		l.flushing = nil
+		l.offset = 0
+	}
+}
+
+// failed records that writing the chunk taken by the writer failed.
+// The whole chunk is written again over the next connection, as the
+// server may have received a truncated record
+func (l *lane) failed() {
+	l.muPending.Lock()
+	defer l.muPending.Unlock()
+
+	if c := l.flushing; c != nil {
+		c.retries++
+		l.offset = 0
+	}
+}
+
+// writePending writes the next chunk to conn. The records posted with
+// PostAsync are registered with acks before being written
+func (l *lane) writePending(conn net.Conn, acks *ackWaiter) (int, error) {
+	if conn == nil {
+		return 0, errors.New(`conn is nil failed to write data to conn`)
+	}
+
+	buf, deliveries := l.take()
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	if pdebug.Enabled {
+		pdebug.Printf("background writer: attempting to write %d bytes", len(buf))
+	}
+
+	acks.add(deliveries)
+	n, err := conn.Write(buf)
+	if err != nil {
+		if pdebug.Enabled {
+			pdebug.Printf("background writer: error while writing: %s", err)
+		}
+		acks.remove(deliveries)
+		l.failed()
+		return 0, errors.Wrap(err, `failed to write data to conn`)
+	}
+	l.written(n)
+	return n, nil
+}
+
+func (l *lane) pendingAvailable(threshold int) bool {
+	l.muPending.RLock()
+	defer l.muPending.RUnlock()
+
+	// records posted with PostAsync are written regardless of the threshold
+	if n := l.buffered(); n > threshold || (n > 0 && l.awaited > 0) {
+		if pdebug.Enabled {
+			pdebug.Printf("background writer: %d bytes to write", n)
+		}
+		return true
+	}
+	return false
+}
+
+// stats adds the state of the lane to s. s.Queues must have one entry
+// per buffer class
+func (l *lane) stats(s *Stats) {
+	l.muPending.RLock()
+	defer l.muPending.RUnlock()
+
+	s.BufferedBytes += l.bytes
+	for i, cl := range l.classes {
+		s.Queues[i].BufferedBytes += cl.bytes
+		s.Queues[i].DroppedRecords += cl.dropped
+		s.Queues[i].ExpiredRecords += cl.expired
+		s.DroppedRecords += cl.dropped
+		s.ExpiredRecords += cl.expired
+	}
+	add := func(c *chunk, queued bool) {
+		s.Records += c.records
+		s.Queues[c.class].Records += c.records
+		if queued {
+			s.QueuedChunks++
+		}
+		s.Chunks = append(s.Chunks, ChunkStats{
+			ID:      c.id,
+			Tag:     c.tag,
+			Records: c.records,
+			Size:    len(c.buf),
+			Created: c.created,
+			Retries: c.retries,
+			Queued:  queued,
+		})
+	}
+	if l.flushing != nil {
+		add(l.flushing, true)
+	}
+	for _, c := range l.queue {
+		add(c, true)
+	}
+	for _, c := range l.open {
+		add(c, false)
+	}
+}
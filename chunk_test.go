@@ -0,0 +1,113 @@
+package fluent_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	fluent "github.com/Edwardsj/fluent-client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunks(t *testing.T) {
+	// nothing listens on this address, and the write threshold is never
+	// reached, so everything stays in the buffer
+	client, err := fluent.NewBuffered(
+		fluent.WithAddress("127.0.0.1:1"),
+		fluent.WithWriteThreshold(1024*1024),
+		fluent.WithChunkSizeLimit(100),
+		fluent.WithChunkLimit(3),
+	)
+	if !assert.NoError(t, err, `NewBuffered should succeed`) {
+		return
+	}
+	defer client.Close()
+
+	record := map[string]interface{}{"message": "0123456789"}
+	for i := 0; i < 3; i++ {
+		if !assert.NoError(t, client.Post("chunk.a", record, fluent.WithSyncAppend(true)), `Post should succeed`) {
+			return
+		}
+	}
+	if !assert.NoError(t, client.Post("chunk.b", record, fluent.WithSyncAppend(true)), `Post should succeed`) {
+		return
+	}
+
+	stats := client.Stats()
+	if !assert.Equal(t, 4, stats.Records, `there should be 4 buffered records`) {
+		return
+	}
+	if !assert.True(t, stats.BufferedBytes > 0, `there should be buffered bytes`) {
+		return
+	}
+	if !assert.Len(t, stats.Chunks, 3, `records should be split into 3 chunks`) {
+		return
+	}
+
+	// the first chunk for chunk.a filled up, and was queued
+	first := stats.Chunks[0]
+	if !assert.Equal(t, "chunk.a", first.Tag, `first chunk should be for chunk.a`) {
+		return
+	}
+	if !assert.True(t, first.Queued, `first chunk should be queued`) {
+		return
+	}
+	if !assert.True(t, first.Size <= 100, `chunk should not exceed the size limit`) {
+		return
+	}
+	if !assert.Equal(t, 1, stats.QueuedChunks, `one chunk should be queued`) {
+		return
+	}
+	for i := 1; i < len(stats.Chunks); i++ {
+		if !assert.True(t, stats.Chunks[i-1].ID < stats.Chunks[i].ID, `chunks should be sorted by ID`) {
+			return
+		}
+	}
+
+	// chunk.c would need a 4th chunk
+	err = client.Post("chunk.c", record, fluent.WithSyncAppend(true))
+	if !assert.True(t, fluent.IsBufferFull(err), `Post should fail with a buffer full error when the chunk limit is reached`) {
+		return
+	}
+}
+
+func TestMaxRecordAge(t *testing.T) {
+	s := newMultiConnServer(t)
+	client, err := fluent.NewBuffered(
+		fluent.WithAddress(s.listener.Addr().String()),
+		fluent.WithWriteThreshold(1024*1024),
+		fluent.WithMaxRecordAge(50*time.Millisecond),
+		fluent.WithTagBuffer(fluent.TagBuffer{Pattern: "keep.*", MaxAge: time.Hour}),
+	)
+	if !assert.NoError(t, err, `NewBuffered should succeed`) {
+		return
+	}
+
+	record := map[string]interface{}{"message": "hello"}
+	for _, tag := range []string{"stale", "stale", "keep.old"} {
+		if !assert.NoError(t, client.Post(tag, record, fluent.WithSyncAppend(true)), `Post should succeed`) {
+			return
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !assert.NoError(t, client.Post("fresh", record, fluent.WithSyncAppend(true)), `Post should succeed`) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if !assert.NoError(t, client.Shutdown(ctx), `Shutdown should succeed`) {
+		return
+	}
+
+	tags := map[string]int{}
+	for _, r := range s.Records(2) {
+		tags[r.tag]++
+	}
+	if !assert.Equal(t, map[string]int{"keep.old": 1, "fresh": 1}, tags, `expired records should not be written`) {
+		return
+	}
+	if !assert.Equal(t, 2, client.Stats().ExpiredRecords, `expired records should be reported`) {
+		return
+	}
+}
@@ -0,0 +1,125 @@
+package fluent
+
+import (
+	"context"
+	"time"
+
+	backoff "github.com/lestrrat-go/backoff"
+)
+
+// Clock is the source of time used by the clients: record timestamps,
+// buffer expiry, connection lifetimes, reconnection backoff, rate limits
+// and periodic tasks all go through it. Use WithClock to replace the
+// system clock, e.g. with the fake clock in the fluenttest package.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a time.Timer created by a Clock
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// Ticker is a time.Ticker created by a Clock
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// WithClock specifies the Clock used by the client. It is also
+// understood by NewFailover, NewFileClient and NewConsole, and by
+// fluent.Ping for the ping interval. By default the system clock is
+// used. Note that write deadlines, dial timeouts and the
+// context given to Shutdown always use the system clock, as they are
+// enforced by the runtime.
+func WithClock(c Clock) Option {
+	return &option{
+		name:  optkeyClock,
+		value: c,
+	}
+}
+
+// SystemClock returns the Clock backed by the time package
+func SystemClock() Clock {
+	return systemClock{}
+}
+
+type systemClock struct{}
+type systemTimer struct{ *time.Timer }
+type systemTicker struct{ *time.Ticker }
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// clockBackoff is an exponential backoff.Policy whose intervals are
+// measured by a Clock. It replaces the default policy when a Clock is
+// specified with WithClock
+type clockBackoff struct {
+	clock    Clock
+	interval time.Duration
+	max      time.Duration
+}
+
+type clockBackoffState struct {
+	ctx  context.Context
+	next chan struct{}
+}
+
+func (b *clockBackoffState) Done() <-chan struct{} {
+	return b.ctx.Done()
+}
+
+func (b *clockBackoffState) Next() <-chan struct{} {
+	return b.next
+}
+
+func (p *clockBackoff) Start(ctx context.Context) (backoff.Backoff, backoff.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	b := &clockBackoffState{
+		ctx:  ctx,
+		next: make(chan struct{}),
+	}
+	go func() {
+		interval := p.interval
+		for {
+			t := p.clock.NewTimer(interval)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return
+			case <-t.C():
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case b.next <- struct{}{}:
+			}
+
+			if interval *= 2; interval > p.max {
+				interval = p.max
+			}
+		}
+	}()
+	return b, backoff.CancelFunc(cancel)
+}
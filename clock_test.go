@@ -0,0 +1,197 @@
+package fluent_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	fluent "github.com/Edwardsj/fluent-client"
+	"github.com/Edwardsj/fluent-client/fluenttest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClock(t *testing.T) {
+	start := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	record := map[string]interface{}{"message": "hello"}
+
+	t.Run("timestamps", func(t *testing.T) {
+		for _, buffered := range []bool{true, false} {
+			clock := fluenttest.NewClock(start)
+			var stamped time.Time
+			client, err := fluent.New(
+				fluent.WithBuffered(buffered),
+				fluent.WithAddress("127.0.0.1:1"),
+				fluent.WithMaxConnAttempts(1),
+				fluent.WithClock(clock),
+				fluent.WithFilters(func(tag string, t time.Time, v interface{}) (string, time.Time, interface{}, bool) {
+					stamped = t
+					return tag, t, v, false
+				}),
+			)
+			if !assert.NoError(t, err, `fluent.New should succeed`) {
+				return
+			}
+			defer client.Close()
+
+			clock.Add(time.Minute)
+			if !assert.NoError(t, client.Post("tag", record), `Post should succeed`) {
+				return
+			}
+			if !assert.Equal(t, start.Add(time.Minute), stamped, `timestamp should come from the clock (buffered=%t)`, buffered) {
+				return
+			}
+		}
+	})
+
+	t.Run("record expiry", func(t *testing.T) {
+		s := newMultiConnServer(t)
+		clock := fluenttest.NewClock(start)
+		client, err := fluent.NewBuffered(
+			fluent.WithAddress(s.listener.Addr().String()),
+			fluent.WithWriteThreshold(1024*1024),
+			fluent.WithMaxRecordAge(time.Minute),
+			fluent.WithClock(clock),
+		)
+		if !assert.NoError(t, err, `NewBuffered should succeed`) {
+			return
+		}
+
+		for _, tag := range []string{"stale", "stale"} {
+			if !assert.NoError(t, client.Post(tag, record, fluent.WithSyncAppend(true)), `Post should succeed`) {
+				return
+			}
+		}
+		clock.Add(2 * time.Minute)
+		if !assert.NoError(t, client.Post("fresh", record, fluent.WithSyncAppend(true)), `Post should succeed`) {
+			return
+		}
+		if !assert.NoError(t, client.Shutdown(context.Background()), `Shutdown should succeed`) {
+			return
+		}
+
+		records := s.Records(1)
+		if !assert.Len(t, records, 1, `only the fresh record should be written`) {
+			return
+		}
+		if !assert.Equal(t, "fresh", records[0].tag, `only the fresh record should be written`) {
+			return
+		}
+		if !assert.Equal(t, 2, client.Stats().ExpiredRecords, `expired records should be reported`) {
+			return
+		}
+	})
+
+	t.Run("rate limit", func(t *testing.T) {
+		clock := fluenttest.NewClock(start)
+		client, err := fluent.NewBuffered(
+			fluent.WithAddress("127.0.0.1:1"),
+			fluent.WithRateLimit(fluent.RateLimit{Rate: 1, Burst: 1}),
+			fluent.WithClock(clock),
+		)
+		if !assert.NoError(t, err, `NewBuffered should succeed`) {
+			return
+		}
+		defer client.Close()
+
+		for i := 0; i < 2; i++ {
+			client.Post("tag", record)
+		}
+		clock.Add(time.Second)
+		client.Post("tag", record)
+		if !assert.Equal(t, uint64(1), client.Suppressed().RateLimited, `only the second record should be rate limited`) {
+			return
+		}
+	})
+
+	t.Run("failover", func(t *testing.T) {
+		clock := fluenttest.NewClock(start)
+		var primary unhealthyClient
+		var secondary tagClient
+		client, err := fluent.NewFailover(&primary, &secondary,
+			fluent.WithFailAfter(time.Minute),
+			fluent.WithRecheckInterval(10*time.Second),
+			fluent.WithClock(clock),
+		)
+		if !assert.NoError(t, err, `NewFailover should succeed`) {
+			return
+		}
+
+		primary.SetFailingSince(start)
+		client.Post("first", nil)
+		clock.Add(time.Minute)
+		client.Post("second", nil)
+
+		primary.SetFailingSince(time.Time{})
+		client.Post("third", nil)
+		clock.Add(10 * time.Second)
+		client.Post("fourth", nil)
+
+		if !assert.Equal(t, []string{"first", "fourth"}, primary.Tags(), `primary should receive records while healthy`) {
+			return
+		}
+		if !assert.Equal(t, []string{"second", "third"}, secondary.Tags(), `failing over should follow the clock`) {
+			return
+		}
+	})
+
+	t.Run("file rotation", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "fluent-clock-")
+		if !assert.NoError(t, err, `TempDir should succeed`) {
+			return
+		}
+		defer os.RemoveAll(dir)
+
+		clock := fluenttest.NewClock(start)
+		path := filepath.Join(dir, "app.log")
+		client, err := fluent.NewFileClient(path,
+			fluent.WithFileRotateInterval(time.Hour),
+			fluent.WithFileMaxAge(2*time.Hour),
+			fluent.WithClock(clock),
+		)
+		if !assert.NoError(t, err, `NewFileClient should succeed`) {
+			return
+		}
+		defer client.Close()
+
+		for _, d := range []time.Duration{0, time.Hour, 3 * time.Hour} {
+			clock.Add(d)
+			if !assert.NoError(t, client.Post("tag", record), `Post should succeed`) {
+				return
+			}
+		}
+
+		// the file rotated an hour after the start is over the max age
+		files, err := filepath.Glob(path + ".*")
+		if !assert.NoError(t, err, `Glob should succeed`) {
+			return
+		}
+		expected := path + "." + start.Add(4*time.Hour).Local().Format("20060102-150405.000000000")
+		if !assert.Equal(t, []string{expected}, files, `files should be rotated and removed by the clock`) {
+			return
+		}
+	})
+
+	t.Run("ping interval", func(t *testing.T) {
+		clock := fluenttest.NewClock(start)
+		rec := fluenttest.NewRecorder()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go fluent.Ping(ctx, rec, "ping", nil, fluent.WithPingInterval(time.Minute), fluent.WithClock(clock))
+
+		if !assert.NoError(t, clock.WaitForTimers(time.Second, 1), `Ping should start its ticker`) {
+			return
+		}
+		for i := 1; i <= 3; i++ {
+			clock.Add(time.Minute)
+			if _, err := rec.WaitForTag(time.Second, "ping", i); !assert.NoError(t, err, `ping #%d should be sent`, i) {
+				return
+			}
+		}
+		if !assert.Equal(t, 3, rec.Count("ping"), `pings should only be sent when the clock advances`) {
+			return
+		}
+	})
+}
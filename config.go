@@ -0,0 +1,477 @@
+package fluent
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	json "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// EnvPrefix is the prefix used for environment variables read by
+// `Config.ReadEnv`. Each variable is named after the corresponding
+// configuration key in upper case, e.g. FLUENT_BUFFER_LIMIT
+const EnvPrefix = "FLUENT_"
+
+const (
+	cfgkeyTLSCertFile           = "tls_cert_file"
+	cfgkeyTLSKeyFile            = "tls_key_file"
+	cfgkeyTLSCAFile             = "tls_ca_file"
+	cfgkeyTLSInsecureSkipVerify = "tls_insecure_skip_verify"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Duration is a time.Duration that can be decoded from human readable
+// strings such as "3s" or "5m" in JSON and YAML configuration files.
+// Plain numbers are interpreted as nanoseconds.
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON decodes a Duration from either a string or a number
+func (d *Duration) UnmarshalJSON(buf []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(buf, &v); err != nil {
+		return errors.Wrap(err, `failed to unmarshal duration`)
+	}
+	return d.set(v)
+}
+
+// UnmarshalYAML decodes a Duration from either a string or a number
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v interface{}
+	if err := unmarshal(&v); err != nil {
+		return errors.Wrap(err, `failed to unmarshal duration`)
+	}
+	return d.set(v)
+}
+
+// MarshalJSON encodes the Duration in its string form
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) set(v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return errors.Wrapf(err, `invalid duration %q`, v)
+		}
+		d.Duration = parsed
+	case float64:
+		d.Duration = time.Duration(v)
+	case int:
+		d.Duration = time.Duration(v)
+	case int64:
+		d.Duration = time.Duration(v)
+	default:
+		return errors.Errorf(`invalid duration type %T`, v)
+	}
+	return nil
+}
+
+// TLSFileConfig describes a TLS setup in terms of files on disk,
+// so that it can be expressed in configuration files and environment
+// variables.
+type TLSFileConfig struct {
+	Enable             bool   `json:"with_tls" yaml:"with_tls"`
+	CertFile           string `json:"tls_cert_file" yaml:"tls_cert_file"`
+	KeyFile            string `json:"tls_key_file" yaml:"tls_key_file"`
+	CAFile             string `json:"tls_ca_file" yaml:"tls_ca_file"`
+	ServerName         string `json:"tls_server_name" yaml:"tls_server_name"`
+	MinVersion         string `json:"tls_min_version" yaml:"tls_min_version"`
+	InsecureSkipVerify bool   `json:"tls_insecure_skip_verify" yaml:"tls_insecure_skip_verify"`
+}
+
+// Config holds every client option in a form that can be loaded from
+// environment variables or JSON/YAML files. Create one with `NewConfig`
+// (or one of the `LoadConfig*` functions) so that unspecified fields
+// carry the same defaults as `fluent.New`.
+type Config struct {
+	Buffered           bool          `json:"buffered" yaml:"buffered"`
+	Network            string        `json:"network" yaml:"network"`
+	Address            string        `json:"address" yaml:"address"`
+	Method             string        `json:"method" yaml:"method"`
+	Marshaler          string        `json:"marshaler" yaml:"marshaler"`
+	TagPrefix          string        `json:"tag_prefix" yaml:"tag_prefix"`
+	Subsecond          bool          `json:"subsecond" yaml:"subsecond"`
+	BufferLimit        int           `json:"buffer_limit" yaml:"buffer_limit"`
+	WriteThreshold     int           `json:"write_threshold" yaml:"write_threshold"`
+	WriteQueueSize     int           `json:"write_queue_size" yaml:"write_queue_size"`
+	MaxConnAttempts    uint64        `json:"max_conn_attempts" yaml:"max_conn_attempts"`
+	DialTimeout        Duration      `json:"dial_timeout" yaml:"dial_timeout"`
+	ConnectOnStart     bool          `json:"connect_on_start" yaml:"connect_on_start"`
+	PingInterval       Duration      `json:"ping_interval" yaml:"ping_interval"`
+	MaxHttpPackageSize int           `json:"max_http_package_size" yaml:"max_http_package_size"`
+	HttpPackageGzip    bool          `json:"http_package_gzip" yaml:"http_package_gzip"`
+	HttpRetries        int           `json:"http_retries" yaml:"http_retries"`
+	Console            bool          `json:"console" yaml:"console"`
+	ConsoleJSON        bool          `json:"console_json" yaml:"console_json"`
+	TLS                TLSFileConfig `json:"tls" yaml:"tls"`
+}
+
+// NewConfig creates a Config populated with the default values
+// used by `fluent.New`
+func NewConfig() *Config {
+	return &Config{
+		Buffered:           true,
+		Network:            "tcp",
+		Address:            defaultAddress,
+		Method:             "forward",
+		Marshaler:          "msgpack",
+		BufferLimit:        defaultBufferLimit,
+		WriteThreshold:     defaultWriteThreshold,
+		WriteQueueSize:     defaultWriteQueueSize,
+		MaxConnAttempts:    defaultMaxConnAttempts,
+		DialTimeout:        Duration{defaultDialTimeout},
+		PingInterval:       Duration{defaultPingInterval},
+		MaxHttpPackageSize: defaultMaxHttpPackageSize,
+		HttpRetries:        defaultHttpRetries,
+	}
+}
+
+// LoadConfigFromEnv creates a Config with default values, and overrides
+// them with values from FLUENT_* environment variables.
+func LoadConfigFromEnv() (*Config, error) {
+	c := NewConfig()
+	if err := c.ReadEnv(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// LoadConfigFile creates a Config with default values, and overrides
+// them with values from the given file. The format is determined by the
+// file extension: ".json" for JSON, ".yaml" or ".yml" for YAML.
+func LoadConfigFile(path string) (*Config, error) {
+	c := NewConfig()
+	if err := c.ReadFile(path); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ReadFile overrides the values in the Config with those found in
+// the given JSON or YAML file. Keys that are not present in the file
+// are left untouched.
+func (c *Config) ReadFile(path string) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, `failed to read config file %s`, path)
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		if err := json.Unmarshal(buf, c); err != nil {
+			return errors.Wrapf(err, `failed to parse JSON config file %s`, path)
+		}
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(buf, c); err != nil {
+			return errors.Wrapf(err, `failed to parse YAML config file %s`, path)
+		}
+	default:
+		return errors.Errorf(`unsupported config file extension %q (expected .json, .yaml or .yml)`, ext)
+	}
+	return nil
+}
+
+// ReadEnv overrides the values in the Config with those found in
+// FLUENT_* environment variables. Variables that are not set are
+// left untouched.
+func (c *Config) ReadEnv() error {
+	var problems []string
+	lookup := func(key string) (string, bool) {
+		return os.LookupEnv(EnvPrefix + strings.ToUpper(key))
+	}
+	str := func(key string, dst *string) {
+		if v, ok := lookup(key); ok {
+			*dst = v
+		}
+	}
+	boolean := func(key string, dst *bool) {
+		if v, ok := lookup(key); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				problems = append(problems, EnvPrefix+strings.ToUpper(key)+`: expected a boolean, got `+strconv.Quote(v))
+				return
+			}
+			*dst = b
+		}
+	}
+	integer := func(key string, dst *int) {
+		if v, ok := lookup(key); ok {
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				problems = append(problems, EnvPrefix+strings.ToUpper(key)+`: expected an integer, got `+strconv.Quote(v))
+				return
+			}
+			*dst = i
+		}
+	}
+	duration := func(key string, dst *Duration) {
+		if v, ok := lookup(key); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				problems = append(problems, EnvPrefix+strings.ToUpper(key)+`: expected a duration, got `+strconv.Quote(v))
+				return
+			}
+			dst.Duration = d
+		}
+	}
+
+	boolean(optkeyBuffered, &c.Buffered)
+	str(optkeyNetwork, &c.Network)
+	str(optkeyAddress, &c.Address)
+	str(optkeyMethod, &c.Method)
+	str(optkeyMarshaler, &c.Marshaler)
+	str(optkeyTagPrefix, &c.TagPrefix)
+	boolean(optkeySubSecond, &c.Subsecond)
+	integer(optkeyBufferLimit, &c.BufferLimit)
+	integer(optkeyWriteThreshold, &c.WriteThreshold)
+	integer(optkeyWriteQueueSize, &c.WriteQueueSize)
+	if v, ok := lookup(optkeyMaxConnAttempts); ok {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			problems = append(problems, EnvPrefix+strings.ToUpper(optkeyMaxConnAttempts)+`: expected a non-negative integer, got `+strconv.Quote(v))
+		} else {
+			c.MaxConnAttempts = n
+		}
+	}
+	duration(optkeyDialTimeout, &c.DialTimeout)
+	boolean(optkeyConnectOnStart, &c.ConnectOnStart)
+	duration(optkeyPingInterval, &c.PingInterval)
+	integer(optkeyMaxHttpPackageSize, &c.MaxHttpPackageSize)
+	boolean(optkeyHttpPackageGzip, &c.HttpPackageGzip)
+	integer(optkeyHttpRetries, &c.HttpRetries)
+	boolean(optkeyConsole, &c.Console)
+	boolean(optkeyConsoleJSON, &c.ConsoleJSON)
+	boolean(optkeyWithTLS, &c.TLS.Enable)
+	str(cfgkeyTLSCertFile, &c.TLS.CertFile)
+	str(cfgkeyTLSKeyFile, &c.TLS.KeyFile)
+	str(cfgkeyTLSCAFile, &c.TLS.CAFile)
+	str(optkeyTLSServerName, &c.TLS.ServerName)
+	str(optkeyTLSMinVersion, &c.TLS.MinVersion)
+	boolean(cfgkeyTLSInsecureSkipVerify, &c.TLS.InsecureSkipVerify)
+
+	if len(problems) > 0 {
+		return errors.Errorf(`invalid environment variables: %s`, strings.Join(problems, `; `))
+	}
+	return nil
+}
+
+// Validate checks that the values in the Config are consistent, and
+// returns an error describing every problem found.
+func (c *Config) Validate() error {
+	var problems []string
+	add := func(key, format string, args ...interface{}) {
+		problems = append(problems, key+`: `+fmt.Sprintf(format, args...))
+	}
+
+	switch c.Network {
+	case "tcp", "unix":
+	default:
+		add(optkeyNetwork, `must be "tcp" or "unix", got %q`, c.Network)
+	}
+
+	switch c.Method {
+	case "forward", "http":
+	default:
+		add(optkeyMethod, `must be "forward" or "http", got %q`, c.Method)
+	}
+
+	switch c.Marshaler {
+	case "", "msgpack", "json", "rawjson":
+	default:
+		add(optkeyMarshaler, `must be one of "msgpack", "json" or "rawjson", got %q`, c.Marshaler)
+	}
+
+	if c.Address == "" {
+		add(optkeyAddress, `must not be empty`)
+	}
+
+	if c.Buffered {
+		if c.BufferLimit <= 0 {
+			add(optkeyBufferLimit, `must be positive, got %d`, c.BufferLimit)
+		}
+		if c.WriteThreshold < 0 {
+			add(optkeyWriteThreshold, `must not be negative, got %d`, c.WriteThreshold)
+		} else if c.BufferLimit > 0 && c.WriteThreshold >= c.BufferLimit {
+			add(optkeyWriteThreshold, `must be smaller than buffer_limit (%d), got %d`, c.BufferLimit, c.WriteThreshold)
+		}
+		if c.WriteQueueSize < 0 {
+			add(optkeyWriteQueueSize, `must not be negative, got %d`, c.WriteQueueSize)
+		}
+		if c.MaxHttpPackageSize < 1 {
+			add(optkeyMaxHttpPackageSize, `must be positive, got %d`, c.MaxHttpPackageSize)
+		}
+		if c.HttpRetries < 0 {
+			add(optkeyHttpRetries, `must not be negative, got %d`, c.HttpRetries)
+		}
+	}
+
+	if c.DialTimeout.Duration <= 0 {
+		add(optkeyDialTimeout, `must be positive, got %s`, c.DialTimeout)
+	}
+
+	if c.PingInterval.Duration <= 0 {
+		add(optkeyPingInterval, `must be positive, got %s`, c.PingInterval)
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		add(cfgkeyTLSCertFile, `tls_cert_file and tls_key_file must be specified together`)
+	}
+	if v := c.TLS.MinVersion; v != "" {
+		if _, ok := tlsVersions[v]; !ok {
+			add(optkeyTLSMinVersion, `must be one of "1.0", "1.1", "1.2" or "1.3", got %q`, v)
+		}
+	}
+	if c.TLS.Enable && c.Network == "unix" {
+		add(optkeyWithTLS, `TLS can not be used with the "unix" network`)
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf(`invalid fluent configuration: %s`, strings.Join(problems, `; `))
+	}
+	return nil
+}
+
+// tlsEnabled returns true if TLS was requested either explicitly, or
+// implicitly by specifying any certificate files
+func (c *Config) tlsEnabled() bool {
+	return c.TLS.Enable || c.TLS.CertFile != "" || c.TLS.CAFile != ""
+}
+
+// TLSConfig loads the certificates referenced by the Config, and
+// creates a tls.Config from them.
+func (c *Config) TLSConfig() (*tls.Config, error) {
+	conf := &tls.Config{
+		ServerName:         c.TLS.ServerName,
+		InsecureSkipVerify: c.TLS.InsecureSkipVerify,
+	}
+	if v := c.TLS.MinVersion; v != "" {
+		version, ok := tlsVersions[v]
+		if !ok {
+			return nil, errors.Errorf(`unknown TLS version %q`, v)
+		}
+		conf.MinVersion = version
+	}
+
+	if c.TLS.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, `failed to load TLS certificate/key pair`)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	if c.TLS.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.TLS.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, `failed to read TLS CA file`)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf(`no certificates found in TLS CA file %s`, c.TLS.CAFile)
+		}
+		conf.RootCAs = pool
+	}
+
+	return conf, nil
+}
+
+// Options validates the Config, and converts it to a list of options
+// suitable for `fluent.New`
+func (c *Config) Options() ([]Option, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	options := []Option{
+		WithBuffered(c.Buffered),
+		WithNetwork(c.Network),
+		WithAddress(c.Address),
+		WithMethod(c.Method),
+		WithSubsecond(c.Subsecond),
+		WithMaxConnAttempts(c.MaxConnAttempts),
+		WithDialTimeout(c.DialTimeout.Duration),
+		WithConnectOnStart(c.ConnectOnStart),
+	}
+
+	switch c.Marshaler {
+	case "json":
+		options = append(options, WithJSONMarshaler())
+	case "rawjson":
+		options = append(options, WithRawJSONMarshaler())
+	default:
+		options = append(options, WithMsgpackMarshaler())
+	}
+
+	if c.TagPrefix != "" {
+		options = append(options, WithTagPrefix(c.TagPrefix))
+	}
+
+	if c.Buffered {
+		options = append(options,
+			WithBufferLimit(c.BufferLimit),
+			WithWriteThreshold(c.WriteThreshold),
+			WithWriteQueueSize(c.WriteQueueSize),
+		)
+		// the HTTP settings have no public option
+		if c.Method == "http" {
+			options = append(options,
+				&option{name: optkeyMaxHttpPackageSize, value: c.MaxHttpPackageSize},
+				&option{name: optkeyHttpPackageGzip, value: c.HttpPackageGzip},
+				&option{name: optkeyHttpRetries, value: c.HttpRetries},
+			)
+		}
+	}
+
+	if c.Console {
+		options = append(options, WithConsole(os.Stdout), WithConsoleJSON(c.ConsoleJSON))
+	}
+
+	if c.tlsEnabled() {
+		options = append(options, WithTLS(tls.Config{InsecureSkipVerify: c.TLS.InsecureSkipVerify}))
+		if c.TLS.CertFile != "" || c.TLS.CAFile != "" {
+			options = append(options, WithTLSFiles(c.TLS.CertFile, c.TLS.KeyFile, c.TLS.CAFile))
+		}
+		if c.TLS.ServerName != "" {
+			options = append(options, WithTLSServerName(c.TLS.ServerName))
+		}
+		if v := c.TLS.MinVersion; v != "" {
+			options = append(options, WithTLSMinVersion(tlsVersions[v]))
+		}
+	}
+
+	return options, nil
+}
+
+// PingOptions returns the options to be passed to `fluent.Ping`
+func (c *Config) PingOptions() []Option {
+	return []Option{WithPingInterval(c.PingInterval.Duration)}
+}
+
+// NewClient validates the Config, and creates either a Buffered or an
+// Unbuffered client from it (or a ConsoleClient, if Console is set).
+func (c *Config) NewClient() (Client, error) {
+	options, err := c.Options()
+	if err != nil {
+		return nil, err
+	}
+	return New(options...)
+}
@@ -0,0 +1,186 @@
+package fluent_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	fluent "github.com/Edwardsj/fluent-client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		c := fluent.NewConfig()
+		if !assert.NoError(t, c.Validate(), "default config should be valid") {
+			return
+		}
+		if !assert.True(t, c.Buffered, "default config should be buffered") {
+			return
+		}
+		// same as fluent.New
+		if !assert.Equal(t, 8*1028, c.WriteThreshold, "default write threshold should match fluent.New") {
+			return
+		}
+		if !assert.Equal(t, 6, c.WriteQueueSize, "default write queue size should match fluent.New") {
+			return
+		}
+		if !assert.Equal(t, 5, c.HttpRetries, "default HTTP retries should match fluent.New") {
+			return
+		}
+	})
+
+	t.Run("environment", func(t *testing.T) {
+		vars := map[string]string{
+			"FLUENT_BUFFERED":              "false",
+			"FLUENT_ADDRESS":               "fluent.example.com:24224",
+			"FLUENT_BUFFER_LIMIT":          "1024",
+			"FLUENT_DIAL_TIMEOUT":          "10s",
+			"FLUENT_TAG_PREFIX":            "app",
+			"FLUENT_HTTP_RETRIES":          "2",
+			"FLUENT_HTTP_PACKAGE_GZIP":     "true",
+			"FLUENT_MAX_HTTP_PACKAGE_SIZE": "20",
+		}
+		for k, v := range vars {
+			os.Setenv(k, v)
+			defer os.Unsetenv(k)
+		}
+
+		c, err := fluent.LoadConfigFromEnv()
+		if !assert.NoError(t, err, "LoadConfigFromEnv should succeed") {
+			return
+		}
+		if !assert.False(t, c.Buffered, "buffered should be overridden") {
+			return
+		}
+		if !assert.Equal(t, "fluent.example.com:24224", c.Address, "address should be overridden") {
+			return
+		}
+		if !assert.Equal(t, 1024, c.BufferLimit, "buffer limit should be overridden") {
+			return
+		}
+		if !assert.Equal(t, 10*time.Second, c.DialTimeout.Duration, "dial timeout should be overridden") {
+			return
+		}
+		if !assert.Equal(t, "app", c.TagPrefix, "tag prefix should be overridden") {
+			return
+		}
+		if !assert.Equal(t, 2, c.HttpRetries, "HTTP retries should be overridden") {
+			return
+		}
+		if !assert.True(t, c.HttpPackageGzip, "HTTP gzip should be overridden") {
+			return
+		}
+		if !assert.Equal(t, 20, c.MaxHttpPackageSize, "max HTTP package size should be overridden") {
+			return
+		}
+
+		os.Setenv("FLUENT_BUFFER_LIMIT", "lots")
+		_, err = fluent.LoadConfigFromEnv()
+		if !assert.Error(t, err, "LoadConfigFromEnv should fail for malformed values") {
+			return
+		}
+	})
+
+	t.Run("files", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "fluent-config-")
+		if !assert.NoError(t, err, "TempDir should succeed") {
+			return
+		}
+		defer os.RemoveAll(dir)
+
+		files := map[string]string{
+			"config.json": `{"network": "unix", "address": "/var/run/fluent.sock", "dial_timeout": "1s", "write_threshold": 16, "http_retries": 3}`,
+			"config.yaml": "network: unix\naddress: /var/run/fluent.sock\ndial_timeout: 1s\nwrite_threshold: 16\nhttp_retries: 3\n",
+		}
+		for name, content := range files {
+			t.Run(name, func(t *testing.T) {
+				path := filepath.Join(dir, name)
+				if !assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0644), "WriteFile should succeed") {
+					return
+				}
+
+				c, err := fluent.LoadConfigFile(path)
+				if !assert.NoError(t, err, "LoadConfigFile should succeed") {
+					return
+				}
+				if !assert.Equal(t, "unix", c.Network, "network should be read from file") {
+					return
+				}
+				if !assert.Equal(t, "/var/run/fluent.sock", c.Address, "address should be read from file") {
+					return
+				}
+				if !assert.Equal(t, time.Second, c.DialTimeout.Duration, "dial timeout should be read from file") {
+					return
+				}
+				if !assert.Equal(t, 16, c.WriteThreshold, "write threshold should be read from file") {
+					return
+				}
+				if !assert.Equal(t, 3, c.HttpRetries, "HTTP retries should be read from file") {
+					return
+				}
+				if !assert.Equal(t, "forward", c.Method, "unspecified keys should keep their defaults") {
+					return
+				}
+			})
+		}
+	})
+
+	t.Run("validation", func(t *testing.T) {
+		c := fluent.NewConfig()
+		c.Network = "udp"
+		c.BufferLimit = -1
+		c.TLS.CertFile = "cert.pem"
+
+		err := c.Validate()
+		if !assert.Error(t, err, "Validate should fail") {
+			return
+		}
+		for _, key := range []string{"network", "buffer_limit", "tls_cert_file"} {
+			if !assert.Contains(t, err.Error(), key, "error should mention %s", key) {
+				return
+			}
+		}
+
+		_, err = c.NewClient()
+		if !assert.Error(t, err, "NewClient should fail for an invalid config") {
+			return
+		}
+	})
+
+	t.Run("NewClient", func(t *testing.T) {
+		c := fluent.NewConfig()
+		c.Buffered = false
+
+		client, err := c.NewClient()
+		if !assert.NoError(t, err, "NewClient should succeed") {
+			return
+		}
+		defer client.Close()
+
+		if !assert.IsType(t, &fluent.Unbuffered{}, client, "NewClient should create an unbuffered client") {
+			return
+		}
+	})
+
+	t.Run("NewClient with HTTP settings", func(t *testing.T) {
+		c := fluent.NewConfig()
+		c.Method = "http"
+		c.HttpPackageGzip = true
+		c.HttpRetries = 0
+
+		client, err := c.NewClient()
+		if !assert.NoError(t, err, "NewClient should accept the HTTP settings") {
+			return
+		}
+		client.Close()
+
+		c.MaxHttpPackageSize = 0
+		_, err = c.NewClient()
+		if !assert.Error(t, err, "NewClient should reject an invalid max HTTP package size") {
+			return
+		}
+	})
+}
@@ -2,7 +2,6 @@ package fluent
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
 	"net"
 	"time"
@@ -10,22 +9,24 @@ import (
 	"github.com/pkg/errors"
 )
 
-func dial(ctx context.Context, network, address string, timeout time.Duration, tlsConfig TLSConfig) (conn net.Conn, err error) {
+// dial connects to address. serverName is the name used to verify the
+// server's certificate when TLS is enabled
+func dial(ctx context.Context, network, address, serverName string, timeout time.Duration, dialFunc DialFunc, tlsConfig *TLSConfig) (conn net.Conn, err error) {
 	connCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	var dialer net.Dialer
-	dialer.Timeout = timeout
-	dialer.KeepAlive = time.Second * 30
+	if dialFunc == nil {
+		dialFunc = defaultDialer(timeout).DialContext
+	}
 
-	if tlsConfig.Enable {
-		conn, err = tls.DialWithDialer(&dialer, network, address, &tlsConfig.Conf)
+	if tlsConfig != nil && tlsConfig.Enable {
+		conn, err = dialTLS(connCtx, dialFunc, network, address, serverName, tlsConfig)
 		if err != nil {
 			fmt.Println(err, `, fluent forward failed to connect to server`)
 			return nil, errors.Wrap(err, `failed to connect to server`)
 		}
 	} else {
-		conn, err = dialer.DialContext(connCtx, network, address)
+		conn, err = dialFunc(connCtx, network, address)
 		if err != nil {
 			fmt.Println(err, `, fluent forward failed to connect to server`)
 			return nil, errors.Wrap(err, `failed to connect to server`)
@@ -0,0 +1,229 @@
+package fluent_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	fluent "github.com/Edwardsj/fluent-client"
+	"github.com/Edwardsj/fluent-client/fluenttest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnbufferedFaults(t *testing.T) {
+	post := func(t *testing.T, d *fluenttest.Dialer, n int, options ...fluent.Option) ([]receivedRecord, error) {
+		s := newMultiConnServer(t)
+		options = append(options,
+			fluent.WithBuffered(false),
+			fluent.WithAddress(s.listener.Addr().String()),
+			fluent.WithDialer(d.Dial),
+			fluent.WithDialTimeout(time.Second),
+		)
+		client, err := fluent.New(options...)
+		if err != nil {
+			return nil, err
+		}
+		defer client.Close()
+
+		for i := 0; i < n; i++ {
+			if err := client.Post("faults", map[string]interface{}{"seq": i}); err != nil {
+				return nil, err
+			}
+		}
+		return s.Records(n), nil
+	}
+
+	t.Run("partial writes", func(t *testing.T) {
+		d := fluenttest.NewDialer(nil)
+		d.Inject(fluenttest.Faults{MaxWrite: 3})
+		records, err := post(t, d, 3)
+		if !assert.NoError(t, err, `Post should succeed`) {
+			return
+		}
+		if !assert.Len(t, records, 3, `all records should be received`) {
+			return
+		}
+	})
+
+	t.Run("remote close", func(t *testing.T) {
+		d := fluenttest.NewDialer(nil)
+		d.Inject(fluenttest.Faults{CloseAfter: 5})
+		records, err := post(t, d, 3)
+		if !assert.NoError(t, err, `Post should succeed`) {
+			return
+		}
+		if !assert.Len(t, records, 3, `all records should be received`) {
+			return
+		}
+		if !assert.Equal(t, 2, d.Dials(), `client should reconnect once`) {
+			return
+		}
+		for _, r := range records {
+			if !assert.Equal(t, 1, r.conn, `records should be received on the new connection`) {
+				return
+			}
+		}
+	})
+
+	t.Run("write failure", func(t *testing.T) {
+		d := fluenttest.NewDialer(nil)
+		d.Inject(fluenttest.Faults{FailAfter: 5}, fluenttest.Faults{FailAfter: 5})
+		records, err := post(t, d, 1, fluent.WithMaxConnAttempts(3))
+		if !assert.NoError(t, err, `Post should succeed on the third connection`) {
+			return
+		}
+		if !assert.Len(t, records, 1, `the record should be received`) {
+			return
+		}
+
+		d = fluenttest.NewDialer(nil)
+		d.Inject(fluenttest.Faults{FailAfter: 5}, fluenttest.Faults{FailAfter: 5})
+		_, err = post(t, d, 1, fluent.WithMaxConnAttempts(2))
+		if !assert.Error(t, err, `Post should fail after two connections`) {
+			return
+		}
+	})
+
+	t.Run("rejected dials", func(t *testing.T) {
+		d := fluenttest.NewDialer(nil)
+		d.Reject(2)
+		records, err := post(t, d, 1, fluent.WithMaxConnAttempts(3))
+		if !assert.NoError(t, err, `Post should succeed`) {
+			return
+		}
+		if !assert.Len(t, records, 1, `the record should be received`) {
+			return
+		}
+
+		d = fluenttest.NewDialer(nil)
+		d.Reject(-1)
+		_, err = post(t, d, 1, fluent.WithMaxConnAttempts(3))
+		if !assert.Error(t, err, `Post should fail`) {
+			return
+		}
+		if !assert.Equal(t, 3, d.Dials(), `every attempt should dial`) {
+			return
+		}
+	})
+}
+
+func TestBufferedFaults(t *testing.T) {
+	const n = 20
+	post := func(t *testing.T, d *fluenttest.Dialer, s *multiConnServer, options ...fluent.Option) fluent.Client {
+		options = append(options,
+			fluent.WithAddress(s.listener.Addr().String()),
+			fluent.WithDialer(d.Dial),
+			fluent.WithDialTimeout(time.Second),
+		)
+		client, err := fluent.New(options...)
+		if !assert.NoError(t, err, `fluent.New should succeed`) {
+			return nil
+		}
+		for i := 0; i < n; i++ {
+			if !assert.NoError(t, client.Post("faults", map[string]interface{}{"seq": i}, fluent.WithSyncAppend(true)), `Post should succeed`) {
+				client.Close()
+				return nil
+			}
+		}
+		return client
+	}
+	// checkRecords verifies that every record was received once, in order
+	checkRecords := func(t *testing.T, records []receivedRecord) bool {
+		if !assert.Len(t, records, n, `every record should be received once`) {
+			return false
+		}
+		for i, r := range records {
+			if !assert.Equal(t, i, r.seq, `records should be received in order`) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, faults := range []fluenttest.Faults{{FailAfter: 10}, {CloseAfter: 10}, {MaxWrite: 7}} {
+		faults := faults
+		t.Run(fmt.Sprintf("%+v", faults), func(t *testing.T) {
+			s := newMultiConnServer(t)
+			d := fluenttest.NewDialer(nil)
+			d.Inject(faults)
+			client := post(t, d, s)
+			if client == nil {
+				return
+			}
+			if !assert.NoError(t, client.Shutdown(context.Background()), `Shutdown should succeed`) {
+				return
+			}
+			checkRecords(t, s.Records(n))
+		})
+	}
+
+	t.Run("flush mode", func(t *testing.T) {
+		s := newMultiConnServer(t)
+		d := fluenttest.NewDialer(nil)
+		d.Reject(3)
+		client := post(t, d, s, fluent.WithMaxConnAttempts(64))
+		if client == nil {
+			return
+		}
+		// the writer keeps trying to connect while flushing
+		if !assert.NoError(t, client.Shutdown(context.Background()), `Shutdown should succeed`) {
+			return
+		}
+		if !checkRecords(t, s.Records(n)) {
+			return
+		}
+		if !assert.True(t, d.Dials() > 3, `writer should dial again after the rejected dials`) {
+			return
+		}
+	})
+
+	t.Run("flush mode gives up", func(t *testing.T) {
+		s := newMultiConnServer(t)
+		defer s.listener.Close()
+		d := fluenttest.NewDialer(nil)
+		d.Reject(-1)
+		client := post(t, d, s, fluent.WithMaxConnAttempts(2))
+		if client == nil {
+			return
+		}
+		err := client.Shutdown(context.Background())
+		undelivered, ok := err.(*fluent.UndeliveredError)
+		if !assert.True(t, ok, `Shutdown should return *UndeliveredError (got %v)`, err) {
+			return
+		}
+		if !assert.Equal(t, n, undelivered.Records(), `every record should be undelivered`) {
+			return
+		}
+	})
+
+	t.Run("stalled connection", func(t *testing.T) {
+		s := newMultiConnServer(t)
+		d := fluenttest.NewDialer(nil)
+		d.Inject(fluenttest.Faults{Stall: true})
+		client := post(t, d, s)
+		if client == nil {
+			return
+		}
+
+		// no write deadline is set in flush mode, so Shutdown can only
+		// give up waiting
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		err := client.Shutdown(ctx)
+		undelivered, ok := err.(*fluent.UndeliveredError)
+		if !assert.True(t, ok, `Shutdown should return *UndeliveredError (got %v)`, err) {
+			return
+		}
+		if !assert.Equal(t, context.DeadlineExceeded, undelivered.Err, `context error should be reported`) {
+			return
+		}
+
+		// once the stalled connection goes away, the writer reconnects
+		// and delivers everything
+		for _, conn := range d.Conns() {
+			conn.Close()
+		}
+		checkRecords(t, s.Records(n))
+	})
+}
@@ -0,0 +1,279 @@
+package fluent
+
+import (
+	"bytes"
+	"context"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	json "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+)
+
+// consoleColors are the ANSI colors used for tags
+var consoleColors = []string{"31", "32", "33", "34", "35", "36", "91", "92", "93", "94", "95", "96"}
+
+// WithConsole specifies that `fluent.New` should create a ConsoleClient
+// writing to w (os.Stdout if nil), instead of a client connecting to
+// fluentd. This allows swapping the client for development without
+// changing the rest of the options.
+func WithConsole(w io.Writer) Option {
+	return &option{
+		name:  optkeyConsole,
+		value: w,
+	}
+}
+
+// WithConsoleJSON specifies that a ConsoleClient should write each
+// record as a line of JSON, with "tag" and "time" keys added (unless
+// the record has its own), instead of pretty-printing it
+func WithConsoleJSON(b bool) Option {
+	return &option{
+		name:  optkeyConsoleJSON,
+		value: b,
+	}
+}
+
+// WithConsoleColor specifies whether a ConsoleClient should colorize the
+// tags. By default, they are colorized when writing to a terminal, unless
+// the NO_COLOR environment variable is set
+func WithConsoleColor(b bool) Option {
+	return &option{
+		name:  optkeyConsoleColor,
+		value: b,
+	}
+}
+
+// ConsoleClient is a Client that prints records in a human readable form,
+// e.g. for local development without fluentd
+type ConsoleClient struct {
+	w         io.Writer
+	json      bool
+	color     bool
+	subsecond bool
+	tagPrefix string
+	filters   []Filter
+	clock     Clock
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewConsole creates a new ConsoleClient. Options may be one of the
+// following:
+//
+//   * fluent.WithClock
+//   * fluent.WithConsole
+//   * fluent.WithConsoleColor
+//   * fluent.WithConsoleJSON
+//   * fluent.WithFilters
+//   * fluent.WithRedaction
+//   * fluent.WithSubsecond
+//   * fluent.WithTagPrefix
+//
+// Other options understood by `fluent.New` are ignored, so that the
+// same options can be used for both.
+func NewConsole(options ...Option) (*ConsoleClient, error) {
+	c := &ConsoleClient{w: os.Stdout, clock: systemClock{}}
+
+	var color *bool
+	check := newOptionChecker(`fluent.NewConsole`)
+	for _, opt := range options {
+		switch opt.Name() {
+		case optkeyConsole:
+			if opt.Value() == nil {
+				continue
+			}
+			if v, ok := opt.Value().(io.Writer); ok && v != nil {
+				c.w = v
+			} else {
+				check.invalid(opt, `expected io.Writer, got %T`, opt.Value())
+			}
+		case optkeyConsoleJSON:
+			if v, ok := check.boolValue(opt); ok {
+				c.json = v
+			}
+		case optkeyConsoleColor:
+			if v, ok := check.boolValue(opt); ok {
+				color = &v
+			}
+		case optkeyFilters:
+			if v, ok := check.filtersValue(opt); ok {
+				c.filters = append(c.filters, v...)
+			}
+		case optkeyRedaction:
+			if v, ok := check.redactionValue(opt); ok {
+				c.filters = append(c.filters, Redact(v...))
+			}
+		case optkeySubSecond:
+			if v, ok := check.boolValue(opt); ok {
+				c.subsecond = v
+			}
+		case optkeyTagPrefix:
+			if v, ok := check.stringValue(opt); ok {
+				c.tagPrefix = v
+			}
+		case optkeyClock:
+			if v, ok := check.clockValue(opt); ok {
+				c.clock = v
+			}
+		default:
+			if _, ok := knownOptions[opt.Name()]; !ok {
+				check.reject(opt)
+			}
+		}
+	}
+	if err := check.result(); err != nil {
+		return nil, err
+	}
+
+	if color != nil {
+		c.color = *color
+	} else {
+		c.color = isTerminal(c.w) && os.Getenv("NO_COLOR") == ""
+	}
+	return c, nil
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Post prints the record. The only option used is fluent.WithTimestamp
+func (c *ConsoleClient) Post(tag string, v interface{}, options ...Option) error {
+	var t time.Time
+	for _, opt := range options {
+		switch opt.Name() {
+		case optkeyTimestamp:
+			t = opt.Value().(time.Time)
+		}
+	}
+	if t.IsZero() {
+		t = c.clock.Now()
+	}
+
+	tag, t, v, ok := applyFilters(c.filters, tag, t, v)
+	if !ok {
+		return nil
+	}
+	if p := c.tagPrefix; len(p) > 0 {
+		tag = p + "." + tag
+	}
+
+	var buf []byte
+	var err error
+	if c.json {
+		buf, err = recordJSON(tag, t, v, c.subsecond)
+		buf = append(buf, '\n')
+	} else {
+		buf, err = c.format(tag, t, v)
+	}
+	if err != nil {
+		return errors.Wrap(err, `failed to format record`)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return errors.New(`client has already been closed`)
+	}
+	if _, err := c.w.Write(buf); err != nil {
+		return errors.Wrap(err, `failed to write record`)
+	}
+	return nil
+}
+
+// Ping prints the record, like Post
+func (c *ConsoleClient) Ping(tag string, v interface{}, options ...Option) error {
+	return c.Post(tag, v, options...)
+}
+
+// format pretty-prints a record: maps are printed as sorted key=value
+// pairs, anything else as JSON
+func (c *ConsoleClient) format(tag string, t time.Time, v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if c.subsecond {
+		buf.WriteString(t.Format("2006-01-02 15:04:05.000000"))
+	} else {
+		buf.WriteString(t.Format("2006-01-02 15:04:05"))
+	}
+	buf.WriteByte(' ')
+	if c.color {
+		h := fnv.New32a()
+		h.Write([]byte(tag))
+		buf.WriteString("\x1b[" + consoleColors[h.Sum32()%uint32(len(consoleColors))] + "m")
+		buf.WriteString(tag)
+		buf.WriteString("\x1b[0m")
+	} else {
+		buf.WriteString(tag)
+	}
+
+	if m, ok := v.(map[string]interface{}); ok {
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			value, err := consoleValue(m[k])
+			if err != nil {
+				return nil, err
+			}
+			buf.WriteByte(' ')
+			buf.WriteString(k)
+			buf.WriteByte('=')
+			buf.WriteString(value)
+		}
+	} else {
+		record, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteByte(' ')
+		buf.Write(record)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// consoleValue formats a single value: strings are quoted only when
+// needed, anything else is printed as JSON
+func consoleValue(v interface{}) (string, error) {
+	if s, ok := v.(string); ok {
+		if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+			return strconv.Quote(s), nil
+		}
+		return s, nil
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// Close stops the client. The writer is not closed, as it usually is
+// os.Stdout or os.Stderr
+func (c *ConsoleClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+// Shutdown is an alias to Close()
+func (c *ConsoleClient) Shutdown(_ context.Context) error {
+	return c.Close()
+}
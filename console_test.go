@@ -0,0 +1,71 @@
+package fluent_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	fluent "github.com/Edwardsj/fluent-client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsole(t *testing.T) {
+	ts := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	record := map[string]interface{}{"message": "hello world", "count": 1, "level": "info"}
+
+	t.Run("pretty", func(t *testing.T) {
+		var buf bytes.Buffer
+		// buffered client options are ignored, so that clients can be swapped
+		client, err := fluent.New(fluent.WithConsole(&buf), fluent.WithBufferLimit(1024), fluent.WithTagPrefix("app"))
+		if !assert.NoError(t, err, `New should succeed`) {
+			return
+		}
+		if !assert.IsType(t, &fluent.ConsoleClient{}, client, `New should create a ConsoleClient`) {
+			return
+		}
+		if !assert.NoError(t, client.Post("test", record, fluent.WithTimestamp(ts)), `Post should succeed`) {
+			return
+		}
+		if !assert.NoError(t, client.Post("test", []int{1, 2}, fluent.WithTimestamp(ts)), `Post should succeed`) {
+			return
+		}
+		if !assert.NoError(t, client.Shutdown(nil), `Shutdown should succeed`) {
+			return
+		}
+		if !assert.Error(t, client.Post("test", record), `Post after Shutdown should fail`) {
+			return
+		}
+
+		expected := "2017-01-02 03:04:05 app.test count=1 level=info message=\"hello world\"\n" +
+			"2017-01-02 03:04:05 app.test [1,2]\n"
+		if !assert.Equal(t, expected, buf.String(), `output should match`) {
+			return
+		}
+	})
+	t.Run("color", func(t *testing.T) {
+		var buf bytes.Buffer
+		client, err := fluent.NewConsole(fluent.WithConsole(&buf), fluent.WithConsoleColor(true))
+		if !assert.NoError(t, err, `NewConsole should succeed`) {
+			return
+		}
+		if !assert.NoError(t, client.Post("test", record, fluent.WithTimestamp(ts)), `Post should succeed`) {
+			return
+		}
+		if !assert.Contains(t, buf.String(), "test\x1b[0m", `tag should be colorized`) {
+			return
+		}
+	})
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		client, err := fluent.NewConsole(fluent.WithConsole(&buf), fluent.WithConsoleJSON(true))
+		if !assert.NoError(t, err, `NewConsole should succeed`) {
+			return
+		}
+		if !assert.NoError(t, client.Post("test", map[string]interface{}{"message": "hello"}, fluent.WithTimestamp(ts)), `Post should succeed`) {
+			return
+		}
+		if !assert.Equal(t, `{"message":"hello","tag":"test","time":"2017-01-02T03:04:05Z"}`+"\n", buf.String(), `output should match`) {
+			return
+		}
+	})
+}
@@ -0,0 +1,293 @@
+package fluent
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	json "github.com/json-iterator/go"
+	msgpack "github.com/lestrrat-go/msgpack"
+	pdebug "github.com/lestrrat-go/pdebug"
+	"github.com/pkg/errors"
+)
+
+// Reasons given to dead letters
+const (
+	// DeadLetterBufferFull is given to records that did not fit in the buffer
+	DeadLetterBufferFull = "buffer full"
+	// DeadLetterRetriesExhausted is given to records that the "http"
+	// method failed to post after all retries
+	DeadLetterRetriesExhausted = "retries exhausted"
+	// DeadLetterConnectFailed is given to records that were still
+	// buffered when the writer gave up connecting during shutdown
+	DeadLetterConnectFailed = "failed to connect"
+)
+
+// DeadLetter is a record that the buffered client could not deliver
+type DeadLetter struct {
+	Tag    string
+	Time   time.Time
+	Record interface{}
+	Reason string
+}
+
+// DeadLetterSink receives the records that could not be delivered.
+// It is called from the background goroutines of the client, and should
+// return quickly
+type DeadLetterSink interface {
+	WriteDeadLetter(*DeadLetter) error
+}
+
+// DeadLetterFunc is a DeadLetterSink implemented as a function
+type DeadLetterFunc func(*DeadLetter)
+
+// WriteDeadLetter calls f
+func (f DeadLetterFunc) WriteDeadLetter(d *DeadLetter) error {
+	f(d)
+	return nil
+}
+
+// WithDeadLetter specifies where the records that the buffered client
+// could not deliver should go, instead of being lost: records rejected
+// because the buffer is full, records the "http" method gave up on, and
+// records still buffered when the writer gives up connecting during
+// shutdown. See NewDeadLetterFile and ReplayDeadLetters
+func WithDeadLetter(sink DeadLetterSink) Option {
+	return &option{
+		name:  optkeyDeadLetter,
+		value: sink,
+	}
+}
+
+// deadLetter hands the given message (or chain of messages) over to
+// the dead letter sink
+func (m *minion) deadLetter(msg *Message, reason string) {
+	if m.deadLetters == nil {
+		return
+	}
+
+	for ; msg != nil; msg = msg.Next {
+		if records, ok := msg.Record.([]interface{}); ok && msg.combined {
+			for _, r := range records {
+				m.writeDeadLetter(&DeadLetter{Tag: msg.Tag, Time: msg.Time.Time, Record: r, Reason: reason})
+			}
+			continue
+		}
+		m.writeDeadLetter(&DeadLetter{Tag: msg.Tag, Time: msg.Time.Time, Record: msg.Record, Reason: reason})
+	}
+}
+
+// deadLetterChunk hands the records serialized in a chunk over to the
+// dead letter sink
+func (m *minion) deadLetterChunk(c *chunk, reason string) {
+	if m.deadLetters == nil {
+		return
+	}
+
+	letters, err := decodeChunk(c)
+	if err != nil {
+		if pdebug.Enabled {
+			pdebug.Printf("dead letter: failed to decode chunk %d: %s", c.id, err)
+		}
+	}
+	for _, d := range letters {
+		d.Reason = reason
+		m.writeDeadLetter(d)
+	}
+}
+
+func (m *minion) writeDeadLetter(d *DeadLetter) {
+	if err := m.deadLetters.WriteDeadLetter(d); err != nil {
+		if pdebug.Enabled {
+			pdebug.Printf("dead letter: failed to write record for %s: %s", d.Tag, err)
+		}
+	}
+}
+
+// decodeChunk turns the records in a chunk back into dead letters. The
+// marshaler is recognized from the first byte: a 4 element msgpack
+// array, a JSON array, or anything else for raw JSON records. If the
+// records cannot be decoded, a single dead letter holding the raw bytes
+// of the chunk is returned along with the error
+func decodeChunk(c *chunk) ([]*DeadLetter, error) {
+	if len(c.buf) == 0 {
+		return nil, nil
+	}
+
+	var letters []*DeadLetter
+	var decode func() error
+	switch c.buf[0] {
+	case 0x94:
+		dec := msgpack.NewDecoder(bytes.NewReader(c.buf))
+		decode = func() error {
+			var msg Message
+			if err := dec.Decode(&msg); err != nil {
+				return err
+			}
+			letters = append(letters, &DeadLetter{Tag: msg.Tag, Time: msg.Time.Time, Record: msg.Record})
+			return nil
+		}
+	case '[':
+		dec := json.NewDecoder(bytes.NewReader(c.buf))
+		decode = func() error {
+			var msg Message
+			if err := dec.Decode(&msg); err != nil {
+				return err
+			}
+			letters = append(letters, &DeadLetter{Tag: msg.Tag, Time: msg.Time.Time, Record: msg.Record})
+			return nil
+		}
+	default:
+		dec := json.NewDecoder(bytes.NewReader(c.buf))
+		decode = func() error {
+			var record interface{}
+			if err := dec.Decode(&record); err != nil {
+				return err
+			}
+			letters = append(letters, &DeadLetter{Tag: c.tag, Time: c.created, Record: record})
+			return nil
+		}
+	}
+
+	for len(letters) < c.records {
+		if err := decode(); err != nil {
+			raw := &DeadLetter{Tag: c.tag, Time: c.created, Record: c.buf}
+			return []*DeadLetter{raw}, errors.Wrap(err, `failed to decode chunk`)
+		}
+	}
+	return letters, nil
+}
+
+// deadLetterEntry is the form in which dead letters are stored in files
+type deadLetterEntry struct {
+	Tag    string      `json:"tag"`
+	Time   string      `json:"time"`
+	Record interface{} `json:"record"`
+	Reason string      `json:"reason"`
+}
+
+// DeadLetterFile is a DeadLetterSink that appends the records to a
+// local file, either as msgpack or as JSON lines
+type DeadLetterFile struct {
+	mu     sync.Mutex
+	file   *os.File
+	encode func(map[string]interface{}) error
+}
+
+// NewDeadLetterFile opens (or creates) the file at path, and appends the
+// dead letters to it. format is either "msgpack" or "json" (one JSON
+// object per line). Use ReplayDeadLetters to send the records again
+func NewDeadLetterFile(path, format string) (*DeadLetterFile, error) {
+	switch format {
+	case "msgpack", "json":
+	default:
+		return nil, errors.Errorf(`unknown dead letter file format %q (expected "msgpack" or "json")`, format)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to open dead letter file`)
+	}
+
+	d := &DeadLetterFile{file: f}
+	if format == "json" {
+		enc := json.NewEncoder(f)
+		d.encode = func(v map[string]interface{}) error { return enc.Encode(v) }
+	} else {
+		enc := msgpack.NewEncoder(f)
+		d.encode = func(v map[string]interface{}) error { return enc.Encode(v) }
+	}
+	return d, nil
+}
+
+// WriteDeadLetter appends a dead letter to the file
+func (d *DeadLetterFile) WriteDeadLetter(letter *DeadLetter) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	err := d.encode(map[string]interface{}{
+		"tag":    letter.Tag,
+		"time":   letter.Time.Format(time.RFC3339Nano),
+		"record": letter.Record,
+		"reason": letter.Reason,
+	})
+	return errors.Wrap(err, `failed to write dead letter`)
+}
+
+// Close closes the file
+func (d *DeadLetterFile) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.file.Close()
+}
+
+// ReplayDeadLetters reads a file written by a DeadLetterFile, and posts
+// each record through client with its original tag (including any tag
+// prefix it was sent with) and timestamp. Additional options are passed
+// to each call to Post. Returns the number of records posted.
+func ReplayDeadLetters(path string, client Client, options ...Option) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, errors.Wrap(err, `failed to open dead letter file`)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	first, err := r.Peek(1)
+	if err != nil {
+		if err == io.EOF {
+			return 0, nil
+		}
+		return 0, errors.Wrap(err, `failed to read dead letter file`)
+	}
+
+	var decode func(*deadLetterEntry) error
+	if first[0] == '{' {
+		// entries are written one per line
+		decode = func(e *deadLetterEntry) error {
+			line, err := r.ReadBytes('\n')
+			if len(bytes.TrimSpace(line)) == 0 {
+				if err == nil {
+					return decode(e)
+				}
+				return err
+			}
+			return json.Unmarshal(line, e)
+		}
+	} else {
+		dec := msgpack.NewDecoder(r)
+		decode = func(e *deadLetterEntry) error {
+			var v map[string]interface{}
+			if err := dec.Decode(&v); err != nil {
+				return err
+			}
+			e.Tag, _ = v["tag"].(string)
+			e.Time, _ = v["time"].(string)
+			e.Record = v["record"]
+			return nil
+		}
+	}
+
+	var posted int
+	for {
+		var e deadLetterEntry
+		if err := decode(&e); err != nil {
+			if err == io.EOF || errors.Cause(err) == io.EOF {
+				return posted, nil
+			}
+			return posted, errors.Wrapf(err, `failed to decode dead letter #%d`, posted+1)
+		}
+
+		postOptions := options
+		if t, err := time.Parse(time.RFC3339Nano, e.Time); err == nil {
+			postOptions = append([]Option{WithTimestamp(t)}, options...)
+		}
+		if err := client.Post(e.Tag, e.Record, postOptions...); err != nil {
+			return posted, errors.Wrapf(err, `failed to post dead letter #%d`, posted+1)
+		}
+		posted++
+	}
+}
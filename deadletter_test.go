@@ -0,0 +1,130 @@
+package fluent_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	fluent "github.com/Edwardsj/fluent-client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadLetter(t *testing.T) {
+	record := map[string]interface{}{"message": "0123456789"}
+
+	t.Run("buffer full", func(t *testing.T) {
+		var mu sync.Mutex
+		var letters []*fluent.DeadLetter
+		sink := fluent.DeadLetterFunc(func(d *fluent.DeadLetter) {
+			mu.Lock()
+			defer mu.Unlock()
+			letters = append(letters, d)
+		})
+
+		client, err := fluent.NewBuffered(
+			fluent.WithAddress("127.0.0.1:1"),
+			fluent.WithBufferLimit(100),
+			fluent.WithWriteThreshold(99),
+			fluent.WithDeadLetter(sink),
+		)
+		if !assert.NoError(t, err, `NewBuffered should succeed`) {
+			return
+		}
+		defer client.Close()
+
+		var rejected int
+		for i := 0; i < 5; i++ {
+			if err := client.Post("dead.full", record, fluent.WithSyncAppend(true)); fluent.IsBufferFull(err) {
+				rejected++
+			}
+		}
+		if !assert.True(t, rejected > 0, `some records should be rejected`) {
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if !assert.Len(t, letters, rejected, `every rejected record should be dead lettered`) {
+			return
+		}
+		if !assert.Equal(t, "dead.full", letters[0].Tag, `tag should match`) {
+			return
+		}
+		if !assert.Equal(t, fluent.DeadLetterBufferFull, letters[0].Reason, `reason should match`) {
+			return
+		}
+		if !assert.Equal(t, record, letters[0].Record, `record should match`) {
+			return
+		}
+	})
+
+	for _, format := range []string{"json", "msgpack"} {
+		format := format
+		t.Run("replay "+format+" file", func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "fluent-deadletter-")
+			if !assert.NoError(t, err, `TempDir should succeed`) {
+				return
+			}
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "dead."+format)
+			sink, err := fluent.NewDeadLetterFile(path, format)
+			if !assert.NoError(t, err, `NewDeadLetterFile should succeed`) {
+				return
+			}
+
+			// nothing listens on this address, so the records are dead
+			// lettered when the writer gives up during shutdown
+			client, err := fluent.NewBuffered(
+				fluent.WithAddress("127.0.0.1:1"),
+				fluent.WithWriteThreshold(1024*1024),
+				fluent.WithMaxConnAttempts(1),
+				fluent.WithDeadLetter(sink),
+			)
+			if !assert.NoError(t, err, `NewBuffered should succeed`) {
+				return
+			}
+			for i := 0; i < 3; i++ {
+				if !assert.NoError(t, client.Post("dead.replay", record, fluent.WithSyncAppend(true)), `Post should succeed`) {
+					return
+				}
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if !assert.IsType(t, &fluent.UndeliveredError{}, client.Shutdown(ctx), `Shutdown should report undelivered records`) {
+				return
+			}
+			if !assert.NoError(t, sink.Close(), `Close should succeed`) {
+				return
+			}
+
+			s := newMultiConnServer(t)
+			replay, err := fluent.New(fluent.WithAddress(s.listener.Addr().String()), fluent.WithWriteThreshold(0))
+			if !assert.NoError(t, err, `fluent.New should succeed`) {
+				return
+			}
+			n, err := fluent.ReplayDeadLetters(path, replay)
+			if !assert.NoError(t, err, `ReplayDeadLetters should succeed`) {
+				return
+			}
+			if !assert.Equal(t, 3, n, `every dead letter should be replayed`) {
+				return
+			}
+			if !assert.NoError(t, replay.Shutdown(ctx), `Shutdown should succeed`) {
+				return
+			}
+
+			records := s.Records(3)
+			if !assert.Len(t, records, 3, `server should receive the replayed records`) {
+				return
+			}
+			if !assert.Equal(t, "dead.replay", records[0].tag, `tag should be preserved`) {
+				return
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package fluent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+
+	pdebug "github.com/lestrrat-go/pdebug"
+	"github.com/pkg/errors"
+)
+
+var (
+	errRecordExpired = errors.New(`record expired before it could be written`)
+	errConnectFailed = errors.New(`failed to connect to server`)
+)
+
+// the stages of a Delivery, in order
+const (
+	deliveryPosted = iota
+	deliveryAppended
+	deliveryWritten
+	deliveryAcked
+)
+
+// Delivery tracks a record posted with PostAsync, through the stages of
+// its delivery: appended to the buffer, written to the server, and
+// acknowledged by the server. The channel of each stage is closed when
+// the record reaches it.
+//
+// If the record cannot be delivered (e.g. the buffer is full, the record
+// expires, or the connection is lost before the server acknowledges it),
+// Err returns the reason, and the channels of the stages that were not
+// reached are closed as well. Records discarded by WithRateLimit,
+// WithSampling or one of the filters given to WithFilters are reported
+// as delivered, as they are by Post.
+type Delivery struct {
+	id       string
+	appended chan struct{}
+	written  chan struct{}
+	acked    chan struct{}
+
+	mu    sync.Mutex
+	stage int
+	err   error
+}
+
+func newDelivery() *Delivery {
+	var id [16]byte
+	rand.Read(id[:])
+	return &Delivery{
+		id:       base64.StdEncoding.EncodeToString(id[:]),
+		appended: make(chan struct{}),
+		written:  make(chan struct{}),
+		acked:    make(chan struct{}),
+	}
+}
+
+// Appended returns a channel that is closed once the record has been
+// appended to the buffer
+func (d *Delivery) Appended() <-chan struct{} {
+	return d.appended
+}
+
+// Written returns a channel that is closed once the record has been
+// written to the server
+func (d *Delivery) Written() <-chan struct{} {
+	return d.written
+}
+
+// Acked returns a channel that is closed once the server has
+// acknowledged the record
+func (d *Delivery) Acked() <-chan struct{} {
+	return d.acked
+}
+
+// Err returns the reason why the record could not be delivered, if any
+func (d *Delivery) Err() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err
+}
+
+// Wait waits until the server has acknowledged the record, and returns
+// nil. If the record cannot be delivered, or ctx is canceled first, the
+// error is returned instead.
+func (d *Delivery) Wait(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-d.acked:
+		return d.Err()
+	}
+}
+
+// advance moves the delivery to the given stage, closing the channels
+// of the stages up to it
+func (d *Delivery) advance(stage int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for d.stage < stage {
+		d.stage++
+		switch d.stage {
+		case deliveryAppended:
+			close(d.appended)
+		case deliveryWritten:
+			close(d.written)
+		case deliveryAcked:
+			close(d.acked)
+		}
+	}
+}
+
+// fail records that the delivery failed, unless it has already been
+// acknowledged
+func (d *Delivery) fail(err error) {
+	d.mu.Lock()
+	if d.stage < deliveryAcked && d.err == nil {
+		d.err = err
+	}
+	d.mu.Unlock()
+
+	d.advance(deliveryAcked)
+}
+
+// reached reports whether the delivery has reached the given stage
+func (d *Delivery) reached(stage int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.stage >= stage
+}
+
+// failDeliveries fails the deliveries of the records in chunks
+func failDeliveries(chunks []*chunk, err error) {
+	for _, c := range chunks {
+		for _, d := range c.deliveries {
+			d.fail(err)
+		}
+	}
+}
+
+// PostAsync posts the given record like Post, and returns a Delivery to
+// track it. The server is asked to acknowledge the record, using the
+// "chunk" option of the forward protocol, which fluentd's in_forward
+// honors.
+//
+// Unlike other records, a record posted with PostAsync is written as soon
+// as possible, regardless of WithWriteThreshold. Post options are the
+// same as for Post, except for WithSyncAppend, which is ignored. The
+// "http" method is not supported.
+func (c *Buffered) PostAsync(tag string, v interface{}, options ...Option) *Delivery {
+	d := newDelivery()
+	if c.method == "http" {
+		d.fail(errors.New(`PostAsync is not supported with the http method`))
+		return d
+	}
+	if err := c.post(tag, v, d, options); err != nil {
+		d.fail(err)
+	}
+	return d
+}
+
+// ackWaiter keeps track of the records written over a connection, that
+// are waiting to be acknowledged by the server
+type ackWaiter struct {
+	mu      sync.Mutex
+	pending map[string]*Delivery
+	closed  bool
+	changed chan struct{} // closed and replaced whenever pending changes
+}
+
+func newAckWaiter() *ackWaiter {
+	return &ackWaiter{
+		pending: make(map[string]*Delivery),
+		changed: make(chan struct{}),
+	}
+}
+
+// notify must be called with mu held
+func (a *ackWaiter) notify() {
+	close(a.changed)
+	a.changed = make(chan struct{})
+}
+
+// add registers deliveries that are about to be written
+func (a *ackWaiter) add(deliveries []*Delivery) {
+	if len(deliveries) == 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, d := range deliveries {
+		a.pending[d.id] = d
+	}
+}
+
+// remove forgets deliveries that failed to be written, as they are
+// written again (and registered again) over the next connection
+func (a *ackWaiter) remove(deliveries []*Delivery) {
+	if len(deliveries) == 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, d := range deliveries {
+		delete(a.pending, d.id)
+	}
+	a.notify()
+}
+
+// ack handles an acknowledgement from the server
+func (a *ackWaiter) ack(id string) {
+	a.mu.Lock()
+	d, ok := a.pending[id]
+	delete(a.pending, id)
+	a.notify()
+	a.mu.Unlock()
+
+	if !ok {
+		if pdebug.Enabled {
+			pdebug.Printf("ack waiter: unexpected ack %s", id)
+		}
+		return
+	}
+	d.advance(deliveryAcked)
+}
+
+// close handles the connection being closed: the records that had been
+// written will never be acknowledged
+func (a *ackWaiter) close() {
+	a.mu.Lock()
+	pending := a.pending
+	a.pending = make(map[string]*Delivery)
+	a.closed = true
+	a.notify()
+	a.mu.Unlock()
+
+	for _, d := range pending {
+		if d.reached(deliveryWritten) {
+			d.fail(errors.New(`connection closed before the record was acknowledged`))
+		}
+	}
+}
+
+// wait waits until every record has been acknowledged, the connection
+// is closed, or timeout passes
+func (a *ackWaiter) wait(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		a.mu.Lock()
+		done := len(a.pending) == 0 || a.closed
+		changed := a.changed
+		a.mu.Unlock()
+
+		if done {
+			return
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return
+		}
+	}
+}
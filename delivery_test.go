@@ -0,0 +1,232 @@
+package fluent_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	fluent "github.com/Edwardsj/fluent-client"
+	msgpack "github.com/lestrrat-go/msgpack"
+	"github.com/stretchr/testify/assert"
+)
+
+// ackServer acknowledges the records that ask for it, like fluentd's
+// in_forward, after delay. If ack is false, it closes the connection
+// instead
+type ackServer struct {
+	listener net.Listener
+	json     bool
+	ack      bool
+	delay    time.Duration
+}
+
+func newAckServer(t *testing.T, useJSON, ack bool) *ackServer {
+	return startAckServer(t, &ackServer{json: useJSON, ack: ack})
+}
+
+func startAckServer(t *testing.T, s *ackServer) *ackServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err, `net.Listen should succeed`) {
+		t.FailNow()
+	}
+	s.listener = l
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *ackServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	decode, encode := msgpack.NewDecoder(conn).Decode, msgpack.NewEncoder(conn).Encode
+	if s.json {
+		decode, encode = json.NewDecoder(conn).Decode, json.NewEncoder(conn).Encode
+	}
+	for {
+		var msg []interface{}
+		if err := decode(&msg); err != nil || len(msg) < 4 {
+			return
+		}
+		option, _ := msg[3].(map[string]interface{})
+		chunk, ok := option["chunk"]
+		if !ok {
+			continue
+		}
+		if !s.ack {
+			return
+		}
+		time.Sleep(s.delay)
+		if err := encode(map[string]interface{}{"ack": chunk}); err != nil {
+			return
+		}
+	}
+}
+
+func TestPostAsync(t *testing.T) {
+	record := map[string]interface{}{"message": "hello"}
+
+	waitCtx := func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(context.Background(), 5*time.Second)
+	}
+
+	for _, useJSON := range []bool{false, true} {
+		useJSON := useJSON
+		name := "msgpack"
+		if useJSON {
+			name = "json"
+		}
+		t.Run("acknowledged ("+name+")", func(t *testing.T) {
+			s := newAckServer(t, useJSON, true)
+			defer s.listener.Close()
+
+			options := []fluent.Option{
+				fluent.WithAddress(s.listener.Addr().String()),
+				fluent.WithWriteThreshold(1024 * 1024),
+			}
+			if useJSON {
+				options = append(options, fluent.WithJSONMarshaler())
+			}
+			client, err := fluent.NewBuffered(options...)
+			if !assert.NoError(t, err, `NewBuffered should succeed`) {
+				return
+			}
+			defer client.Close()
+
+			// written despite the write threshold
+			d := client.PostAsync("tag", record)
+			ctx, cancel := waitCtx()
+			defer cancel()
+			if !assert.NoError(t, d.Wait(ctx), `Wait should succeed`) {
+				return
+			}
+			for name, ch := range map[string]<-chan struct{}{"Appended": d.Appended(), "Written": d.Written(), "Acked": d.Acked()} {
+				select {
+				case <-ch:
+				default:
+					assert.Fail(t, name+` should be closed`)
+					return
+				}
+			}
+		})
+	}
+
+	t.Run("connection closed before ack", func(t *testing.T) {
+		s := newAckServer(t, false, false)
+		defer s.listener.Close()
+
+		client, err := fluent.NewBuffered(fluent.WithAddress(s.listener.Addr().String()))
+		if !assert.NoError(t, err, `NewBuffered should succeed`) {
+			return
+		}
+		defer client.Close()
+
+		d := client.PostAsync("tag", record)
+		ctx, cancel := waitCtx()
+		defer cancel()
+		if !assert.Error(t, d.Wait(ctx), `Wait should fail`) {
+			return
+		}
+		if !assert.NoError(t, ctx.Err(), `Wait should not time out`) {
+			return
+		}
+		select {
+		case <-d.Written():
+		default:
+			assert.Fail(t, `Written should be closed`)
+		}
+	})
+
+	t.Run("connection max lifetime", func(t *testing.T) {
+		s := startAckServer(t, &ackServer{ack: true, delay: 500 * time.Millisecond})
+		defer s.listener.Close()
+
+		client, err := fluent.NewBuffered(
+			fluent.WithAddress(s.listener.Addr().String()),
+			fluent.WithConnMaxLifetime(50*time.Millisecond),
+		)
+		if !assert.NoError(t, err, `NewBuffered should succeed`) {
+			return
+		}
+		defer client.Close()
+
+		first := client.PostAsync("tag", record)
+		select {
+		case <-first.Written():
+		case <-time.After(5 * time.Second):
+			assert.Fail(t, `the first record should be written`)
+			return
+		}
+		// the connection is retired while the first record has not
+		// been acknowledged yet
+		time.Sleep(100 * time.Millisecond)
+		second := client.PostAsync("tag", record)
+		// the writer does not wait for the acknowledgements of the
+		// retired connection before using a new one
+		select {
+		case <-second.Written():
+		case <-time.After(200 * time.Millisecond):
+			assert.Fail(t, `the second record should be written without waiting for the first ack`)
+			return
+		}
+
+		ctx, cancel := waitCtx()
+		defer cancel()
+		if !assert.NoError(t, first.Wait(ctx), `the first record should be acknowledged before the connection is closed`) {
+			return
+		}
+		if !assert.NoError(t, second.Wait(ctx), `the second record should be acknowledged over a new connection`) {
+			return
+		}
+	})
+
+	t.Run("buffer full", func(t *testing.T) {
+		client, err := fluent.NewBuffered(
+			fluent.WithAddress("127.0.0.1:1"),
+			fluent.WithBufferLimit(8),
+		)
+		if !assert.NoError(t, err, `NewBuffered should succeed`) {
+			return
+		}
+		defer client.Close()
+
+		d := client.PostAsync("tag", record)
+		ctx, cancel := waitCtx()
+		defer cancel()
+		if !assert.True(t, fluent.IsBufferFull(d.Wait(ctx)), `Wait should report a full buffer`) {
+			return
+		}
+	})
+
+	t.Run("filtered", func(t *testing.T) {
+		client, err := fluent.NewBuffered(
+			fluent.WithAddress("127.0.0.1:1"),
+			fluent.WithFilters(func(tag string, t time.Time, v interface{}) (string, time.Time, interface{}, bool) {
+				return tag, t, v, false
+			}),
+		)
+		if !assert.NoError(t, err, `NewBuffered should succeed`) {
+			return
+		}
+		defer client.Close()
+
+		d := client.PostAsync("tag", record)
+		select {
+		case <-d.Acked():
+		default:
+			assert.Fail(t, `dropped records should be reported as delivered right away`)
+			return
+		}
+		if !assert.NoError(t, d.Err(), `dropped records should not fail`) {
+			return
+		}
+	})
+}
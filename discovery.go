@@ -0,0 +1,270 @@
+package fluent
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pdebug "github.com/lestrrat-go/pdebug"
+	"github.com/pkg/errors"
+)
+
+// Resolver is used to discover the servers to connect to. *net.Resolver
+// satisfies this interface; tests may provide a fake.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// WithSRVLookup specifies that the servers to connect to should be
+// discovered from the DNS SRV records of name, e.g.
+// "_fluentd._tcp.aggregators.example.com". Only the targets with the
+// lowest priority are used. The address specified by WithAddress is
+// used as a fallback when the lookup fails.
+//
+// Connections are rotated across the resolved servers, and the records
+// are looked up again periodically (see WithResolveInterval), or after
+// a failure to connect.
+func WithSRVLookup(name string) Option {
+	return &option{
+		name:  optkeySRVLookup,
+		value: name,
+	}
+}
+
+// WithHostLookup specifies that the host part of the address given by
+// WithAddress should be resolved to all of its A/AAAA records, and that
+// connections should be rotated across them. Like WithSRVLookup, the
+// records are looked up again periodically, or after a failure to connect.
+func WithHostLookup(b bool) Option {
+	return &option{
+		name:  optkeyHostLookup,
+		value: b,
+	}
+}
+
+// WithResolver specifies the Resolver used by WithSRVLookup and
+// WithHostLookup. The default is net.DefaultResolver
+func WithResolver(r Resolver) Option {
+	return &option{
+		name:  optkeyResolver,
+		value: r,
+	}
+}
+
+// WithResolveInterval specifies how often the servers discovered via
+// WithSRVLookup or WithHostLookup are looked up again. The default
+// value is 30 seconds
+func WithResolveInterval(d time.Duration) Option {
+	return &option{
+		name:  optkeyResolveInterval,
+		value: d,
+	}
+}
+
+func isDiscoveryOption(name string) bool {
+	switch name {
+	case optkeySRVLookup, optkeyHostLookup, optkeyResolver, optkeyResolveInterval:
+		return true
+	}
+	return false
+}
+
+// serverSet keeps track of the servers discovered through DNS, and
+// hands them out in a round-robin fashion. A nil *serverSet always
+// hands out the fallback address
+type serverSet struct {
+	resolver   Resolver
+	srvName    string
+	lookupHost bool
+	address    string
+	interval   time.Duration
+	timeout    time.Duration
+	clock      Clock
+
+	mu       sync.Mutex
+	addrs    []string
+	next     int
+	resolved time.Time
+	stale    bool
+}
+
+// newServerSet assembles a serverSet from the discovery related options.
+// Problems are recorded in check. Returns nil if discovery was not requested
+func newServerSet(check *optionChecker, options []Option, network, address string, timeout time.Duration, clock Clock) *serverSet {
+	s := &serverSet{
+		resolver: net.DefaultResolver,
+		address:  address,
+		interval: 30 * time.Second,
+		timeout:  timeout,
+		clock:    clock,
+	}
+	for _, opt := range options {
+		switch opt.Name() {
+		case optkeySRVLookup:
+			if v, ok := check.nonEmptyString(opt); ok {
+				s.srvName = v
+			}
+		case optkeyHostLookup:
+			if v, ok := check.boolValue(opt); ok {
+				s.lookupHost = v
+			}
+		case optkeyResolver:
+			if v, ok := opt.Value().(Resolver); ok && v != nil {
+				s.resolver = v
+			} else {
+				check.invalid(opt, `expected a non-nil Resolver, got %T`, opt.Value())
+			}
+		case optkeyResolveInterval:
+			if v, ok := check.durationValue(opt); ok {
+				s.interval = v
+			}
+		}
+	}
+
+	if s.srvName == "" && !s.lookupHost {
+		return nil
+	}
+	if network != "tcp" {
+		for _, opt := range options {
+			if opt.Name() == optkeySRVLookup || opt.Name() == optkeyHostLookup {
+				check.invalid(opt, `server discovery requires the "tcp" network, got %q`, network)
+			}
+		}
+		return nil
+	}
+	return s
+}
+
+// pick returns the address to use for the next connection, along with
+// the server name to verify when using TLS. With WithHostLookup, the
+// server name is the configured host, not the resolved IP address
+func (s *serverSet) pick(ctx context.Context, fallback string) (string, string) {
+	if s == nil {
+		return fallback, hostname(fallback)
+	}
+
+	s.mu.Lock()
+	now := s.clock.Now()
+	refresh := s.stale || len(s.addrs) == 0 || now.Sub(s.resolved) >= s.interval
+	if refresh {
+		// claim the refresh, so that the other writers keep using the
+		// known servers instead of waiting for the lookup
+		s.resolved = now
+		s.stale = false
+	}
+	s.mu.Unlock()
+
+	if refresh {
+		s.refresh(ctx)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.addrs) == 0 {
+		return fallback, hostname(fallback)
+	}
+	addr := s.addrs[s.next%len(s.addrs)]
+	s.next++
+	if s.srvName != "" {
+		return addr, hostname(addr)
+	}
+	return addr, hostname(s.address)
+}
+
+// hostname returns the host part of address
+func hostname(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return host
+}
+
+// failed notifies the set that connecting to addr failed, so that the
+// servers are looked up again before the next connection
+func (s *serverSet) failed(addr string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pdebug.Enabled {
+		pdebug.Printf("discovery: failed to connect to %s, marking server list as stale", addr)
+	}
+	s.stale = true
+}
+
+// refresh looks up the servers. On failure the previous list is kept,
+// as a broken DNS server should not stop us from sending data to the
+// servers we already know about. Must be called without s.mu held, so
+// that a slow resolver does not block the other writers
+func (s *serverSet) refresh(ctx context.Context) {
+	lookupCtx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	addrs, err := s.lookup(lookupCtx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		if pdebug.Enabled {
+			pdebug.Printf("discovery: lookup failed, keeping %d known servers: %s", len(s.addrs), err)
+		}
+		return
+	}
+
+	if pdebug.Enabled {
+		pdebug.Printf("discovery: resolved servers %v", addrs)
+	}
+	s.addrs = addrs
+}
+
+func (s *serverSet) lookup(ctx context.Context) ([]string, error) {
+	if s.srvName != "" {
+		_, records, err := s.resolver.LookupSRV(ctx, "", "", s.srvName)
+		if err != nil {
+			return nil, errors.Wrapf(err, `failed to lookup SRV records for %s`, s.srvName)
+		}
+		if len(records) == 0 {
+			return nil, errors.Errorf(`no SRV records found for %s`, s.srvName)
+		}
+
+		// records are sorted by priority, so only keep the first group
+		var addrs []string
+		for _, r := range records {
+			if r.Priority != records[0].Priority {
+				break
+			}
+			host := strings.TrimSuffix(r.Target, ".")
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(r.Port))))
+		}
+		return addrs, nil
+	}
+
+	host, port, err := net.SplitHostPort(s.address)
+	if err != nil {
+		return nil, errors.Wrapf(err, `failed to parse address %s`, s.address)
+	}
+	if net.ParseIP(host) != nil {
+		return []string{s.address}, nil
+	}
+
+	hosts, err := s.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, errors.Wrapf(err, `failed to lookup host %s`, host)
+	}
+	if len(hosts) == 0 {
+		return nil, errors.Errorf(`no addresses found for %s`, host)
+	}
+
+	addrs := make([]string, len(hosts))
+	for i, h := range hosts {
+		addrs[i] = net.JoinHostPort(h, port)
+	}
+	return addrs, nil
+}
@@ -0,0 +1,237 @@
+package fluent_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	fluent "github.com/Edwardsj/fluent-client"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeResolver struct {
+	mu      sync.Mutex
+	records []*net.SRV
+	lookups int
+}
+
+func (r *fakeResolver) LookupSRV(_ context.Context, _, _, _ string) (string, []*net.SRV, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	return "", r.records, nil
+}
+
+func (r *fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	return []string{host}, nil
+}
+
+func (r *fakeResolver) setRecords(records ...*net.SRV) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = records
+}
+
+func (r *fakeResolver) lookupCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups
+}
+
+// hostResolver resolves host names from a fixed table
+type hostResolver map[string][]string
+
+func (r hostResolver) LookupSRV(_ context.Context, _, _, name string) (string, []*net.SRV, error) {
+	return "", nil, errors.Errorf(`no SRV records for %s`, name)
+}
+
+func (r hostResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	if addrs, ok := r[host]; ok {
+		return addrs, nil
+	}
+	return nil, errors.Errorf(`no such host %s`, host)
+}
+
+// acceptServer accepts connections, and reports its address for each one
+func acceptServer(t *testing.T, accepted chan string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err, `net.Listen should succeed`) {
+		t.FailNow()
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- l.Addr().String()
+			conn.Close()
+		}
+	}()
+	return l
+}
+
+func srvRecord(t *testing.T, l net.Listener, priority uint16) *net.SRV {
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	if !assert.NoError(t, err, `SplitHostPort should succeed`) {
+		t.FailNow()
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.SRV{Target: "127.0.0.1.", Port: uint16(p), Priority: priority}
+}
+
+func TestServerDiscovery(t *testing.T) {
+	accepted := make(chan string, 16)
+	l1 := acceptServer(t, accepted)
+	defer l1.Close()
+	l2 := acceptServer(t, accepted)
+	defer l2.Close()
+	backup := acceptServer(t, accepted)
+	defer backup.Close()
+
+	resolver := &fakeResolver{}
+	resolver.setRecords(srvRecord(t, l1, 10), srvRecord(t, l2, 10), srvRecord(t, backup, 20))
+
+	client, err := fluent.NewUnbuffered(
+		fluent.WithSRVLookup("_fluentd._tcp.example.com"),
+		fluent.WithResolver(resolver),
+		fluent.WithResolveInterval(time.Hour),
+	)
+	if !assert.NoError(t, err, `NewUnbuffered should succeed`) {
+		return
+	}
+	defer client.Close()
+
+	connect := func() string {
+		client.Close()
+		client.Post("discovery.test", map[string]interface{}{"foo": "bar"})
+		select {
+		case addr := <-accepted:
+			return addr
+		case <-time.After(5 * time.Second):
+			t.Errorf(`timed out waiting for a connection`)
+			return ""
+		}
+	}
+
+	t.Run("round robin", func(t *testing.T) {
+		seen := map[string]int{}
+		for i := 0; i < 4; i++ {
+			seen[connect()]++
+		}
+		if !assert.Equal(t, map[string]int{l1.Addr().String(): 2, l2.Addr().String(): 2}, seen, `connections should rotate across the lowest priority servers`) {
+			return
+		}
+		if !assert.Equal(t, 1, resolver.lookupCount(), `records should be looked up once`) {
+			return
+		}
+	})
+
+	t.Run("re-resolve after failure", func(t *testing.T) {
+		dead, err := net.Listen("tcp", "127.0.0.1:0")
+		if !assert.NoError(t, err, `net.Listen should succeed`) {
+			return
+		}
+		deadRecord := srvRecord(t, dead, 1)
+		dead.Close()
+
+		resolver.setRecords(deadRecord)
+		client, err := fluent.NewUnbuffered(
+			fluent.WithSRVLookup("_fluentd._tcp.example.com"),
+			fluent.WithResolver(resolver),
+			fluent.WithResolveInterval(time.Hour),
+			fluent.WithMaxConnAttempts(1),
+		)
+		if !assert.NoError(t, err, `NewUnbuffered should succeed`) {
+			return
+		}
+		defer client.Close()
+
+		before := resolver.lookupCount()
+		if !assert.Error(t, client.Post("discovery.test", "hello"), `Post to a dead server should fail`) {
+			return
+		}
+
+		resolver.setRecords(srvRecord(t, backup, 20))
+		if !assert.NoError(t, client.Post("discovery.test", "hello"), `Post should succeed after re-resolving`) {
+			return
+		}
+		select {
+		case addr := <-accepted:
+			if !assert.Equal(t, backup.Addr().String(), addr, `client should connect to the newly resolved server`) {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf(`timed out waiting for a connection`)
+			return
+		}
+		if !assert.True(t, resolver.lookupCount() > before+1, `records should be looked up again after a failure`) {
+			return
+		}
+	})
+
+	t.Run("requires tcp", func(t *testing.T) {
+		_, err := fluent.NewUnbuffered(
+			fluent.WithNetwork("unix"),
+			fluent.WithSRVLookup("_fluentd._tcp.example.com"),
+		)
+		if !assert.Error(t, err, `NewUnbuffered should fail`) {
+			return
+		}
+	})
+}
+
+func TestServerDiscoveryTLS(t *testing.T) {
+	ca := newTestCert(t, 1, nil, true)
+	serverCert := newTestCert(t, 2, ca, false, "fluent.example.com")
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert.tlsCertificate()},
+	})
+	if !assert.NoError(t, err, `tls.Listen should succeed`) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				for {
+					if _, err := conn.Read(buf); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	client, err := fluent.NewUnbuffered(
+		fluent.WithAddress(net.JoinHostPort("fluent.example.com", port)),
+		fluent.WithHostLookup(true),
+		fluent.WithResolver(hostResolver{"fluent.example.com": {"127.0.0.1"}}),
+		fluent.WithTLS(tls.Config{RootCAs: pool}),
+	)
+	if !assert.NoError(t, err, `NewUnbuffered should succeed`) {
+		return
+	}
+	defer client.Close()
+
+	// the certificate is only valid for the host name, not for the
+	// address it resolves to
+	if !assert.NoError(t, client.Post("discovery.test", map[string]interface{}{"foo": "bar"}), `Post should verify the configured host name`) {
+		return
+	}
+}
@@ -1,5 +1,10 @@
 package fluent
 
+import (
+	"fmt"
+	"strings"
+)
+
 type bufferFullErr struct{}
 type bufferFuller interface {
 	BufferFull() bool
@@ -34,3 +39,94 @@ func (e *bufferFullErr) BufferFull() bool {
 func (e *bufferFullErr) Error() string {
 	return `buffer full`
 }
+
+// OptionError is returned by the client constructors when one or more
+// of the given options could not be used. Invalid lists options whose
+// values were of the wrong type or out of range, Unknown lists options
+// that are not recognized at all, and Misapplied lists options that
+// are valid elsewhere (e.g. in `Post`) but not for the constructor
+// that received them.
+type OptionError struct {
+	Constructor string
+	Invalid     []string
+	Unknown     []string
+	Misapplied  []string
+}
+
+func (e *OptionError) Error() string {
+	var parts []string
+	if len(e.Invalid) > 0 {
+		parts = append(parts, `invalid options: `+strings.Join(e.Invalid, `, `))
+	}
+	if len(e.Unknown) > 0 {
+		parts = append(parts, `unknown options: `+strings.Join(e.Unknown, `, `))
+	}
+	if len(e.Misapplied) > 0 {
+		parts = append(parts, `options not applicable to `+e.Constructor+`: `+strings.Join(e.Misapplied, `, `))
+	}
+	return e.Constructor + `: ` + strings.Join(parts, `; `)
+}
+
+// UndeliveredError is returned by `(*Buffered).Shutdown` when records
+// could not be delivered before the client stopped: either the writer
+// gave up connecting to the server while flushing, the "http" method
+// failed to post them after Close, or the context given to Shutdown
+// expired first. These records are counted whether or not they are
+// also handed to a dead letter sink. Records dropped before Close (e.g.
+// because the buffer was full, or their HTTP retries ran out) are not
+// counted, as they were already reported to the caller or the sink.
+//
+// Pending counts the records (and their serialized size) that were in
+// the buffer, Incoming counts those still waiting to be buffered, and
+// HTTP counts those queued for the "http" method. Err is the context
+// error, if Shutdown returned because of it.
+type UndeliveredError struct {
+	PendingRecords  int
+	PendingBytes    int
+	IncomingRecords int
+	HTTPRecords     int
+	Err             error
+}
+
+// Records returns the total number of undelivered records
+func (e *UndeliveredError) Records() int {
+	return e.PendingRecords + e.IncomingRecords + e.HTTPRecords
+}
+
+func (e *UndeliveredError) Error() string {
+	msg := fmt.Sprintf(`%d records undelivered at shutdown (pending: %d records/%d bytes, incoming: %d, http: %d)`, e.Records(), e.PendingRecords, e.PendingBytes, e.IncomingRecords, e.HTTPRecords)
+	if e.Err != nil {
+		msg += `: ` + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the context error, if any, so that errors.Is keeps
+// working for callers that check for context.DeadlineExceeded
+func (e *UndeliveredError) Unwrap() error {
+	return e.Err
+}
+
+// MultiError is returned when more than one of the clients wrapped by
+// a Router or Multi fail
+type MultiError []error
+
+func (e MultiError) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf(`%d errors: %s`, len(e), strings.Join(msgs, `; `))
+}
+
+// errorOrNil returns nil if there are no errors, and the error itself
+// if there is only one, so that e.g. IsBufferFull keeps working
+func (e MultiError) errorOrNil() error {
+	switch len(e) {
+	case 0:
+		return nil
+	case 1:
+		return e[0]
+	}
+	return e
+}
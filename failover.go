@@ -0,0 +1,210 @@
+package fluent
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	pdebug "github.com/lestrrat-go/pdebug"
+	"github.com/pkg/errors"
+)
+
+// WithFailAfter specifies how long the primary client of a Failover may
+// fail to deliver records before the secondary client is used instead.
+// The default value is 30 seconds
+func WithFailAfter(d time.Duration) Option {
+	return &option{
+		name:  optkeyFailAfter,
+		value: d,
+	}
+}
+
+// WithRecheckInterval specifies how often a Failover that has switched
+// to its secondary client checks whether the primary client has
+// recovered. The default value is 10 seconds
+func WithRecheckInterval(d time.Duration) Option {
+	return &option{
+		name:  optkeyRecheckInterval,
+		value: d,
+	}
+}
+
+// Failover is a Client that normally sends records to a primary client,
+// and switches to a secondary client (e.g. one writing to a local file)
+// when the primary cannot deliver them. This happens when the primary
+// returns an error from Post, when its buffer is full, or when it reports that it has been failing to
+// deliver records for longer than WithFailAfter (see
+// Buffered.FailingSince).
+//
+// Once switched, the primary is checked every WithRecheckInterval, and
+// used again as soon as it is no longer failing.
+type Failover struct {
+	primary         Client
+	secondary       Client
+	failAfter       time.Duration
+	recheckInterval time.Duration
+	clock           Clock
+
+	mu         sync.Mutex
+	failedOver bool
+	checkedAt  time.Time
+}
+
+// NewFailover creates a new Failover client. Options may be one of the
+// following:
+//
+//   * fluent.WithClock
+//   * fluent.WithFailAfter
+//   * fluent.WithRecheckInterval
+//
+func NewFailover(primary, secondary Client, options ...Option) (*Failover, error) {
+	if primary == nil || secondary == nil {
+		return nil, errors.New(`both a primary and a secondary client are required`)
+	}
+
+	f := &Failover{
+		primary:         primary,
+		secondary:       secondary,
+		failAfter:       30 * time.Second,
+		recheckInterval: 10 * time.Second,
+		clock:           systemClock{},
+	}
+
+	check := newOptionChecker(`fluent.NewFailover`)
+	for _, opt := range options {
+		switch opt.Name() {
+		case optkeyFailAfter:
+			if v, ok := check.durationValue(opt); ok {
+				f.failAfter = v
+			}
+		case optkeyRecheckInterval:
+			if v, ok := check.durationValue(opt); ok {
+				f.recheckInterval = v
+			}
+		case optkeyClock:
+			if v, ok := check.clockValue(opt); ok {
+				f.clock = v
+			}
+		default:
+			check.reject(opt)
+		}
+	}
+	if err := check.result(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// FailedOver returns true while records are being sent to the
+// secondary client
+func (f *Failover) FailedOver() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.failedOver
+}
+
+// usePrimary decides whether the next record goes to the primary client
+func (f *Failover) usePrimary() bool {
+	var since time.Time
+	if h, ok := f.primary.(interface{ FailingSince() time.Time }); ok {
+		since = h.FailingSince()
+	}
+	// without WithSyncAppend, Post does not report a full buffer, so
+	// the buffer counts as full once an average record no longer fits
+	var full bool
+	if h, ok := f.primary.(interface{ bufferUsage() bufferUsage }); ok {
+		u := h.bufferUsage()
+		if u.limit > 0 {
+			var avg int
+			if u.records > 0 {
+				avg = u.bytes / u.records
+			}
+			full = u.limit-u.bytes <= avg
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.clock.Now()
+	if !f.failedOver {
+		switch {
+		case full:
+			if pdebug.Enabled {
+				pdebug.Printf("failover: primary buffer is full, switching to secondary")
+			}
+			f.failedOver = true
+			f.checkedAt = now
+		case !since.IsZero() && now.Sub(since) >= f.failAfter:
+			if pdebug.Enabled {
+				pdebug.Printf("failover: primary has been failing since %s, switching to secondary", since)
+			}
+			f.failedOver = true
+			f.checkedAt = now
+		}
+		return !f.failedOver
+	}
+
+	if now.Sub(f.checkedAt) < f.recheckInterval {
+		return false
+	}
+	f.checkedAt = now
+	if !since.IsZero() || full {
+		return false
+	}
+	if pdebug.Enabled {
+		pdebug.Printf("failover: primary has recovered, switching back")
+	}
+	f.failedOver = false
+	return true
+}
+
+func (f *Failover) failover(err error) {
+	if pdebug.Enabled {
+		pdebug.Printf("failover: primary failed (%s), switching to secondary", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failedOver = true
+	f.checkedAt = f.clock.Now()
+}
+
+// Post posts the record to the primary client or, if it is failing, to
+// the secondary client. A record rejected by the primary is posted to
+// the secondary client
+func (f *Failover) Post(tag string, v interface{}, options ...Option) error {
+	if f.usePrimary() {
+		err := f.primary.Post(tag, v, options...)
+		if err == nil {
+			return nil
+		}
+		f.failover(err)
+	}
+	return f.secondary.Post(tag, v, options...)
+}
+
+// Ping pings the client that records are currently sent to
+func (f *Failover) Ping(tag string, v interface{}, options ...Option) error {
+	if f.usePrimary() {
+		return f.primary.Ping(tag, v, options...)
+	}
+	return f.secondary.Ping(tag, v, options...)
+}
+
+// Close closes both clients
+func (f *Failover) Close() error {
+	var errs MultiError
+	for _, c := range []Client{f.primary, f.secondary} {
+		if err := c.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs.errorOrNil()
+}
+
+// Shutdown shuts both clients down concurrently, and waits for them (or
+// for ctx to be canceled)
+func (f *Failover) Shutdown(ctx context.Context) error {
+	return shutdownAll(ctx, []Client{f.primary, f.secondary})
+}
@@ -0,0 +1,154 @@
+package fluent_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	fluent "github.com/Edwardsj/fluent-client"
+	"github.com/stretchr/testify/assert"
+)
+
+// unhealthyClient is a tagClient that reports whether it is failing
+type unhealthyClient struct {
+	tagClient
+	muSince sync.Mutex
+	since   time.Time
+}
+
+func (c *unhealthyClient) FailingSince() time.Time {
+	c.muSince.Lock()
+	defer c.muSince.Unlock()
+	return c.since
+}
+
+func (c *unhealthyClient) SetFailingSince(t time.Time) {
+	c.muSince.Lock()
+	defer c.muSince.Unlock()
+	c.since = t
+}
+
+func TestFailover(t *testing.T) {
+	t.Run("buffer full", func(t *testing.T) {
+		primary, err := fluent.NewBuffered(
+			fluent.WithAddress("127.0.0.1:1"),
+			fluent.WithBufferLimit(100),
+			fluent.WithWriteThreshold(99),
+		)
+		if !assert.NoError(t, err, `NewBuffered should succeed`) {
+			return
+		}
+		defer primary.Close()
+
+		var secondary tagClient
+		client, err := fluent.NewFailover(primary, &secondary)
+		if !assert.NoError(t, err, `NewFailover should succeed`) {
+			return
+		}
+		for i := 0; i < 5; i++ {
+			if !assert.NoError(t, client.Post("tag", map[string]interface{}{"message": "0123456789"}, fluent.WithSyncAppend(true)), `Post should succeed`) {
+				return
+			}
+		}
+		if !assert.True(t, client.FailedOver(), `client should fail over`) {
+			return
+		}
+		if !assert.NotEmpty(t, secondary.Tags(), `records should go to the secondary client`) {
+			return
+		}
+	})
+
+	t.Run("buffer full without sync append", func(t *testing.T) {
+		primary, err := fluent.NewBuffered(
+			fluent.WithAddress("127.0.0.1:1"),
+			fluent.WithBufferLimit(100),
+			fluent.WithWriteThreshold(1024*1024),
+		)
+		if !assert.NoError(t, err, `NewBuffered should succeed`) {
+			return
+		}
+		defer primary.Close()
+
+		var secondary tagClient
+		client, err := fluent.NewFailover(primary, &secondary)
+		if !assert.NoError(t, err, `NewFailover should succeed`) {
+			return
+		}
+		// records are appended to the buffer in the background, so keep
+		// posting until the buffer is seen to be full
+		deadline := time.Now().Add(5 * time.Second)
+		for !client.FailedOver() && time.Now().Before(deadline) {
+			if !assert.NoError(t, client.Post("tag", map[string]interface{}{"message": "0123456789"}), `Post should succeed`) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !assert.True(t, client.FailedOver(), `client should fail over`) {
+			return
+		}
+		if !assert.NoError(t, client.Post("tag", map[string]interface{}{"message": "0123456789"}), `Post should succeed`) {
+			return
+		}
+		if !assert.NotEmpty(t, secondary.Tags(), `records should go to the secondary client`) {
+			return
+		}
+	})
+
+	t.Run("failing connection", func(t *testing.T) {
+		primary, err := fluent.NewBuffered(
+			fluent.WithAddress("127.0.0.1:1"),
+			fluent.WithWriteThreshold(0),
+		)
+		if !assert.NoError(t, err, `NewBuffered should succeed`) {
+			return
+		}
+		defer primary.Close()
+
+		if !assert.NoError(t, primary.Post("tag", map[string]interface{}{"message": "hello"}), `Post should succeed`) {
+			return
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for primary.FailingSince().IsZero() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !assert.False(t, primary.FailingSince().IsZero(), `primary should report that it is failing`) {
+			return
+		}
+	})
+
+	t.Run("switch back", func(t *testing.T) {
+		var primary unhealthyClient
+		var secondary tagClient
+		client, err := fluent.NewFailover(&primary, &secondary,
+			fluent.WithFailAfter(50*time.Millisecond),
+			fluent.WithRecheckInterval(50*time.Millisecond),
+		)
+		if !assert.NoError(t, err, `NewFailover should succeed`) {
+			return
+		}
+
+		primary.SetFailingSince(time.Now())
+		client.Post("first", nil)
+		time.Sleep(60 * time.Millisecond)
+		client.Post("second", nil)
+
+		primary.SetFailingSince(time.Time{})
+		client.Post("third", nil)
+		time.Sleep(60 * time.Millisecond)
+		client.Post("fourth", nil)
+
+		if !assert.Equal(t, []string{"first", "fourth"}, primary.Tags(), `primary should receive records while healthy`) {
+			return
+		}
+		if !assert.Equal(t, []string{"second", "third"}, secondary.Tags(), `secondary should receive records until the primary recovers`) {
+			return
+		}
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		_, err := fluent.NewFailover(&tagClient{}, &tagClient{}, fluent.WithBufferLimit(10))
+		if !assert.IsType(t, &fluent.OptionError{}, err, `inapplicable options should be rejected`) {
+			return
+		}
+	})
+}
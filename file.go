@@ -0,0 +1,460 @@
+package fluent
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	json "github.com/json-iterator/go"
+	msgpack "github.com/lestrrat-go/msgpack"
+	pdebug "github.com/lestrrat-go/pdebug"
+	"github.com/pkg/errors"
+)
+
+// rotatedSuffix is the layout of the suffix added to rotated files
+const rotatedSuffix = "20060102-150405.000000000"
+
+// WithFileFormat specifies the format of the records written by a
+// FileClient. It may be one of the following:
+//
+//   * "json": one JSON object per line, with "tag" and "time" keys added
+//     (include_tag_key / include_time_key of fluentd's out_file) unless
+//     the record has its own. This is the default
+//   * "out_file": the time, the tag and the record as JSON, separated by
+//     tabs (the default format of fluentd's out_file)
+//   * "msgpack": a stream of msgpack encoded [tag, time, record] arrays,
+//     as in fluentd's forward protocol. Unlike out_file's msgpack format,
+//     the tag and time are kept
+//
+func WithFileFormat(format string) Option {
+	return &option{
+		name:  optkeyFileFormat,
+		value: format,
+	}
+}
+
+// WithFileMaxSize specifies the size (e.g. 10485760 or "10MB") after which
+// the file written by a FileClient is rotated. By default files are not
+// rotated by size
+func WithFileMaxSize(size interface{}) Option {
+	return &option{
+		name:  optkeyFileMaxSize,
+		value: size,
+	}
+}
+
+// WithFileRotateInterval specifies how often the file written by a
+// FileClient is rotated. By default files are not rotated by time
+func WithFileRotateInterval(d time.Duration) Option {
+	return &option{
+		name:  optkeyFileRotateInterval,
+		value: d,
+	}
+}
+
+// WithFileMaxBackups specifies how many rotated files are kept. By
+// default all of them are kept
+func WithFileMaxBackups(n int) Option {
+	return &option{
+		name:  optkeyFileMaxBackups,
+		value: n,
+	}
+}
+
+// WithFileMaxAge specifies how long rotated files are kept, counting from
+// their rotation. By default they are kept forever
+func WithFileMaxAge(d time.Duration) Option {
+	return &option{
+		name:  optkeyFileMaxAge,
+		value: d,
+	}
+}
+
+// FileClient is a Client that writes records to a local file instead of
+// sending them to a server, e.g. for local development or air-gapped
+// environments. Rotated files are renamed by adding the time of the
+// rotation to their name, e.g. "app.log.20170101-150405.000000000".
+type FileClient struct {
+	path           string
+	format         string
+	maxSize        int
+	rotateInterval time.Duration
+	maxBackups     int
+	maxAge         time.Duration
+	subsecond      bool
+	tagPrefix      string
+	filters        []Filter
+	clock          Clock
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int
+	openedAt time.Time
+	closed   bool
+}
+
+// NewFileClient creates a new FileClient writing to path, which is
+// created if it does not exist, and appended to otherwise. Options may
+// be one of the following:
+//
+//   * fluent.WithClock
+//   * fluent.WithFileFormat
+//   * fluent.WithFileMaxAge
+//   * fluent.WithFileMaxBackups
+//   * fluent.WithFileMaxSize
+//   * fluent.WithFileRotateInterval
+//   * fluent.WithFilters
+//   * fluent.WithRedaction
+//   * fluent.WithSubsecond
+//   * fluent.WithTagPrefix
+//
+func NewFileClient(path string, options ...Option) (client *FileClient, err error) {
+	if pdebug.Enabled {
+		g := pdebug.Marker("fluent.NewFileClient").BindError(&err)
+		defer g.End()
+	}
+
+	c := &FileClient{
+		path:   path,
+		format: "json",
+		clock:  systemClock{},
+	}
+
+	check := newOptionChecker(`fluent.NewFileClient`)
+	for _, opt := range options {
+		switch opt.Name() {
+		case optkeyFileFormat:
+			if v, ok := check.choice(opt, "json", "out_file", "msgpack"); ok {
+				c.format = v
+			}
+		case optkeyFileMaxSize:
+			if v, ok := check.sizeValue(opt); ok {
+				c.maxSize = v
+			}
+		case optkeyFileRotateInterval:
+			if v, ok := check.durationValue(opt); ok {
+				c.rotateInterval = v
+			}
+		case optkeyFileMaxBackups:
+			if v, ok := check.intValue(opt, 0); ok {
+				c.maxBackups = v
+			}
+		case optkeyFileMaxAge:
+			if v, ok := check.durationValue(opt); ok {
+				c.maxAge = v
+			}
+		case optkeyFilters:
+			if v, ok := check.filtersValue(opt); ok {
+				c.filters = append(c.filters, v...)
+			}
+		case optkeyRedaction:
+			if v, ok := check.redactionValue(opt); ok {
+				c.filters = append(c.filters, Redact(v...))
+			}
+		case optkeySubSecond:
+			if v, ok := check.boolValue(opt); ok {
+				c.subsecond = v
+			}
+		case optkeyTagPrefix:
+			if v, ok := check.stringValue(opt); ok {
+				c.tagPrefix = v
+			}
+		case optkeyClock:
+			if v, ok := check.clockValue(opt); ok {
+				c.clock = v
+			}
+		default:
+			check.reject(opt)
+		}
+	}
+	if err := check.result(); err != nil {
+		return nil, err
+	}
+
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// open opens the file for appending. Must be called with mu held
+func (c *FileClient) open() error {
+	f, err := os.OpenFile(c.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, `failed to open file`)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, `failed to stat file`)
+	}
+	c.file = f
+	c.size = int(fi.Size())
+	c.openedAt = c.clock.Now()
+	return nil
+}
+
+// Post writes the record to the file. The only option used is
+// fluent.WithTimestamp
+func (c *FileClient) Post(tag string, v interface{}, options ...Option) (err error) {
+	if pdebug.Enabled {
+		g := pdebug.Marker("fluent.FileClient.Post").BindError(&err)
+		defer g.End()
+	}
+
+	var t time.Time
+	for _, opt := range options {
+		switch opt.Name() {
+		case optkeyTimestamp:
+			t = opt.Value().(time.Time)
+		}
+	}
+	if t.IsZero() {
+		t = c.clock.Now()
+	}
+
+	tag, t, v, ok := applyFilters(c.filters, tag, t, v)
+	if !ok {
+		return nil
+	}
+	if p := c.tagPrefix; len(p) > 0 {
+		tag = p + "." + tag
+	}
+
+	buf, err := c.encode(tag, t, v)
+	if err != nil {
+		return errors.Wrap(err, `failed to serialize payload`)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return errors.New(`client has already been closed`)
+	}
+	if c.shouldRotate(len(buf)) {
+		if err := c.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := c.file.Write(buf)
+	c.size += n
+	if err != nil {
+		return errors.Wrap(err, `failed to write to file`)
+	}
+	return nil
+}
+
+// Ping writes the record to the file, like Post
+func (c *FileClient) Ping(tag string, v interface{}, options ...Option) error {
+	return c.Post(tag, v, options...)
+}
+
+func (c *FileClient) encode(tag string, t time.Time, v interface{}) ([]byte, error) {
+	switch c.format {
+	case "msgpack":
+		return msgpack.Marshal(&fileEntry{tag: tag, time: t, record: v, subsecond: c.subsecond})
+	case "out_file":
+		record, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		buf.WriteString(formatTime(t, c.subsecond))
+		buf.WriteByte('\t')
+		buf.WriteString(tag)
+		buf.WriteByte('\t')
+		buf.Write(record)
+		buf.WriteByte('\n')
+		return buf.Bytes(), nil
+	default:
+		buf, err := recordJSON(tag, t, v, c.subsecond)
+		if err != nil {
+			return nil, err
+		}
+		return append(buf, '\n'), nil
+	}
+}
+
+// fileEntry is a record of the "msgpack" file format
+type fileEntry struct {
+	tag       string
+	time      time.Time
+	record    interface{}
+	subsecond bool
+}
+
+// EncodeMsgpack serializes the entry as [tag, time, record]
+func (e *fileEntry) EncodeMsgpack(enc *msgpack.Encoder) error {
+	if err := enc.EncodeArrayHeader(3); err != nil {
+		return errors.Wrap(err, `failed to encode array header`)
+	}
+	if err := enc.EncodeString(e.tag); err != nil {
+		return errors.Wrap(err, `failed to encode tag`)
+	}
+	if e.subsecond {
+		if err := enc.EncodeStruct(EventTime{Time: e.time}); err != nil {
+			return errors.Wrap(err, `failed to encode time`)
+		}
+	} else {
+		if err := enc.EncodeInt64(e.time.Unix()); err != nil {
+			return errors.Wrap(err, `failed to encode time`)
+		}
+	}
+	if err := enc.Encode(e.record); err != nil {
+		return errors.Wrap(err, `failed to encode record`)
+	}
+	return nil
+}
+
+// recordJSON encodes v as a JSON object, with "tag" and "time" keys
+// added, unless the record already has keys of the same name. Records
+// that are not encoded as objects are put in a "record" key
+func recordJSON(tag string, t time.Time, v interface{}, subsecond bool) ([]byte, error) {
+	record, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	record = bytes.TrimSpace(record)
+
+	var fields map[string]json.RawMessage
+	var buf bytes.Buffer
+	if len(record) > 1 && record[0] == '{' {
+		if err := json.Unmarshal(record, &fields); err != nil {
+			return nil, err
+		}
+		buf.Write(record[:len(record)-1])
+	} else {
+		buf.WriteString(`{"record":`)
+		buf.Write(record)
+		fields = map[string]json.RawMessage{"record": nil}
+	}
+
+	add := func(key string, value []byte) {
+		if _, ok := fields[key]; ok {
+			return
+		}
+		if len(fields) > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(`"` + key + `":`)
+		buf.Write(value)
+		fields[key] = value
+	}
+	tagJSON, _ := json.Marshal(tag)
+	add("tag", tagJSON)
+	add("time", []byte(`"`+formatTime(t, subsecond)+`"`))
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func formatTime(t time.Time, subsecond bool) string {
+	if subsecond {
+		return t.Format(time.RFC3339Nano)
+	}
+	return t.Format(time.RFC3339)
+}
+
+// shouldRotate reports whether the file must be rotated before writing
+// size more bytes. Must be called with mu held
+func (c *FileClient) shouldRotate(size int) bool {
+	if c.maxSize > 0 && c.size > 0 && c.size+size > c.maxSize {
+		return true
+	}
+	return c.rotateInterval > 0 && c.clock.Now().Sub(c.openedAt) >= c.rotateInterval
+}
+
+// rotate renames the current file, opens a new one, and removes the
+// rotated files that should no longer be kept. Must be called with mu held
+func (c *FileClient) rotate() error {
+	if pdebug.Enabled {
+		pdebug.Printf("file client: rotating %s", c.path)
+	}
+	if err := c.file.Close(); err != nil {
+		return errors.Wrap(err, `failed to close file`)
+	}
+	if err := os.Rename(c.path, c.path+"."+c.clock.Now().Local().Format(rotatedSuffix)); err != nil {
+		// keep appending to the current file
+		if oerr := c.open(); oerr != nil {
+			return oerr
+		}
+		return errors.Wrap(err, `failed to rename file`)
+	}
+	if err := c.open(); err != nil {
+		return err
+	}
+	c.prune()
+	return nil
+}
+
+// prune removes the rotated files beyond the retention limits. Failures
+// are ignored, so that a stray file does not prevent writing records
+func (c *FileClient) prune() {
+	if c.maxBackups == 0 && c.maxAge == 0 {
+		return
+	}
+
+	dir, base := filepath.Split(c.path)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	type rotatedFile struct {
+		name      string
+		rotatedAt time.Time
+	}
+	var rotated []rotatedFile
+	for _, fi := range entries {
+		suffix := strings.TrimPrefix(fi.Name(), base+".")
+		if suffix == fi.Name() || fi.IsDir() {
+			continue
+		}
+		// the suffix is the time of the rotation, in local time
+		at, err := time.ParseInLocation(rotatedSuffix, suffix, time.Local)
+		if err != nil {
+			continue
+		}
+		rotated = append(rotated, rotatedFile{name: fi.Name(), rotatedAt: at})
+	}
+	// newest first
+	sort.Slice(rotated, func(i, j int) bool { return rotated[i].name > rotated[j].name })
+
+	now := c.clock.Now()
+	for i, f := range rotated {
+		if (c.maxBackups > 0 && i >= c.maxBackups) || (c.maxAge > 0 && now.Sub(f.rotatedAt) > c.maxAge) {
+			if pdebug.Enabled {
+				pdebug.Printf("file client: removing %s", f.name)
+			}
+			os.Remove(filepath.Join(dir, f.name))
+		}
+	}
+}
+
+// Close closes the file. Records posted afterwards are rejected
+func (c *FileClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.file.Close()
+}
+
+// Shutdown is an alias to Close(), as records are written as soon as
+// they are posted
+func (c *FileClient) Shutdown(_ context.Context) error {
+	return c.Close()
+}
@@ -0,0 +1,158 @@
+package fluent_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	fluent "github.com/Edwardsj/fluent-client"
+	msgpack "github.com/lestrrat-go/msgpack"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fluent-file-")
+	if !assert.NoError(t, err, `TempDir should succeed`) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	ts := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	record := map[string]interface{}{"message": "hello"}
+
+	formats := map[string]string{
+		"json":     `{"message":"hello","tag":"app.test","time":"2017-01-02T03:04:05Z"}` + "\n",
+		"out_file": "2017-01-02T03:04:05Z\tapp.test\t" + `{"message":"hello"}` + "\n",
+	}
+	for format, expected := range formats {
+		path := filepath.Join(dir, format+".log")
+		client, err := fluent.NewFileClient(path, fluent.WithFileFormat(format), fluent.WithTagPrefix("app"))
+		if !assert.NoError(t, err, `NewFileClient should succeed`) {
+			return
+		}
+		if !assert.NoError(t, client.Post("test", record, fluent.WithTimestamp(ts)), `Post should succeed`) {
+			return
+		}
+		if !assert.NoError(t, client.Shutdown(nil), `Shutdown should succeed`) {
+			return
+		}
+		if !assert.Error(t, client.Post("test", record), `Post after Shutdown should fail`) {
+			return
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if !assert.NoError(t, err, `ReadFile should succeed`) {
+			return
+		}
+		if !assert.Equal(t, expected, string(content), `%s file should match`, format) {
+			return
+		}
+	}
+
+	t.Run("existing keys", func(t *testing.T) {
+		path := filepath.Join(dir, "existing.log")
+		client, err := fluent.NewFileClient(path)
+		if !assert.NoError(t, err, `NewFileClient should succeed`) {
+			return
+		}
+		own := map[string]interface{}{"message": "hello", "time": "yesterday"}
+		if !assert.NoError(t, client.Post("test", own, fluent.WithTimestamp(ts)), `Post should succeed`) {
+			return
+		}
+		client.Close()
+
+		content, err := ioutil.ReadFile(path)
+		if !assert.NoError(t, err, `ReadFile should succeed`) {
+			return
+		}
+		if !assert.Equal(t, 1, strings.Count(string(content), `"time"`), `the record's own keys should not be duplicated`) {
+			return
+		}
+		var decoded map[string]interface{}
+		if !assert.NoError(t, json.Unmarshal(content, &decoded), `Unmarshal should succeed`) {
+			return
+		}
+		expected := map[string]interface{}{"message": "hello", "time": "yesterday", "tag": "test"}
+		if !assert.Equal(t, expected, decoded, `the record's own keys should be kept`) {
+			return
+		}
+	})
+
+	t.Run("msgpack", func(t *testing.T) {
+		path := filepath.Join(dir, "msgpack.log")
+		client, err := fluent.NewFileClient(path, fluent.WithFileFormat("msgpack"))
+		if !assert.NoError(t, err, `NewFileClient should succeed`) {
+			return
+		}
+		for i := 0; i < 2; i++ {
+			if !assert.NoError(t, client.Post("test", record, fluent.WithTimestamp(ts)), `Post should succeed`) {
+				return
+			}
+		}
+		client.Close()
+
+		f, err := os.Open(path)
+		if !assert.NoError(t, err, `Open should succeed`) {
+			return
+		}
+		defer f.Close()
+		dec := msgpack.NewDecoder(bufio.NewReader(f))
+		for i := 0; i < 2; i++ {
+			var entry []interface{}
+			if !assert.NoError(t, dec.Decode(&entry), `Decode should succeed`) {
+				return
+			}
+			if !assert.Len(t, entry, 3, `entries should be [tag, time, record]`) {
+				return
+			}
+			if !assert.Equal(t, "test", entry[0], `tag should match`) {
+				return
+			}
+			if !assert.EqualValues(t, ts.Unix(), entry[1], `time should match`) {
+				return
+			}
+			if !assert.Equal(t, record, entry[2], `record should match`) {
+				return
+			}
+		}
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		path := filepath.Join(dir, "rotated.log")
+		client, err := fluent.NewFileClient(path, fluent.WithFileMaxSize(100), fluent.WithFileMaxBackups(2))
+		if !assert.NoError(t, err, `NewFileClient should succeed`) {
+			return
+		}
+		defer client.Close()
+
+		// each record takes about 70 bytes, so every record after the
+		// first one causes a rotation
+		for i := 0; i < 5; i++ {
+			if !assert.NoError(t, client.Post("test", record), `Post should succeed`) {
+				return
+			}
+		}
+
+		files, err := filepath.Glob(path + ".*")
+		if !assert.NoError(t, err, `Glob should succeed`) {
+			return
+		}
+		if !assert.Len(t, files, 2, `only two rotated files should be kept`) {
+			return
+		}
+		for _, file := range files {
+			content, err := ioutil.ReadFile(file)
+			if !assert.NoError(t, err, `ReadFile should succeed`) {
+				return
+			}
+			if !assert.Equal(t, 1, strings.Count(string(content), "\n"), `each rotated file should hold one record`) {
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,108 @@
+package fluent
+
+import (
+	"regexp"
+	"time"
+)
+
+// Filter is applied to each record given to Post, before it is encoded.
+// It returns the tag, time and record to use instead, or false if the
+// record should be dropped. Filters must not modify the given record in
+// place, as the caller may still be using it; the built-in filters
+// return a copy instead.
+//
+// The built-in filters handle records of type map[string]interface{};
+// other records are passed through unchanged.
+type Filter func(tag string, t time.Time, record interface{}) (string, time.Time, interface{}, bool)
+
+// WithFilters specifies filters that are applied, in order, to every
+// record given to Post. May be specified multiple times, in which case
+// the filters are appended. A dropped record is not reported as an error.
+func WithFilters(filters ...Filter) Option {
+	return &option{
+		name:  optkeyFilters,
+		value: filters,
+	}
+}
+
+// AddFields returns a Filter that adds the given fields, e.g. the host
+// name or the environment, to each record. Keys already present in the
+// record are left alone.
+func AddFields(fields map[string]interface{}) Filter {
+	return func(tag string, t time.Time, record interface{}) (string, time.Time, interface{}, bool) {
+		m, ok := record.(map[string]interface{})
+		if !ok {
+			return tag, t, record, true
+		}
+		out := make(map[string]interface{}, len(m)+len(fields))
+		for k, v := range fields {
+			out[k] = v
+		}
+		for k, v := range m {
+			out[k] = v
+		}
+		return tag, t, out, true
+	}
+}
+
+// RenameKeys returns a Filter that renames the keys of each record,
+// according to the given old name to new name mapping.
+func RenameKeys(names map[string]string) Filter {
+	return func(tag string, t time.Time, record interface{}) (string, time.Time, interface{}, bool) {
+		m, ok := record.(map[string]interface{})
+		if !ok {
+			return tag, t, record, true
+		}
+		out := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			if name, ok := names[k]; ok {
+				k = name
+			}
+			out[k] = v
+		}
+		return tag, t, out, true
+	}
+}
+
+// RemoveKeys returns a Filter that removes the given keys, e.g. secrets,
+// from each record.
+func RemoveKeys(keys ...string) Filter {
+	remove := make(map[string]struct{}, len(keys))
+	for _, k := range keys {
+		remove[k] = struct{}{}
+	}
+	return func(tag string, t time.Time, record interface{}) (string, time.Time, interface{}, bool) {
+		m, ok := record.(map[string]interface{})
+		if !ok {
+			return tag, t, record, true
+		}
+		out := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			if _, ok := remove[k]; !ok {
+				out[k] = v
+			}
+		}
+		return tag, t, out, true
+	}
+}
+
+// RewriteTag returns a Filter that replaces the tags matching re with
+// replacement, which may refer to submatches as in
+// regexp.ReplaceAllString, e.g. RewriteTag(regexp.MustCompile(`^app\.(.*)$`), "service.$1")
+func RewriteTag(re *regexp.Regexp, replacement string) Filter {
+	return func(tag string, t time.Time, record interface{}) (string, time.Time, interface{}, bool) {
+		return re.ReplaceAllString(tag, replacement), t, record, true
+	}
+}
+
+// applyFilters runs the record through filters, in order. Returns false
+// if one of them dropped it
+func applyFilters(filters []Filter, tag string, t time.Time, record interface{}) (string, time.Time, interface{}, bool) {
+	for _, f := range filters {
+		var ok bool
+		if tag, t, record, ok = f(tag, t, record); !ok {
+			return tag, t, record, false
+		}
+	}
+	return tag, t, record, true
+}
@@ -0,0 +1,78 @@
+package fluent_test
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	fluent "github.com/Edwardsj/fluent-client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilters(t *testing.T) {
+	t.Run("built-in filters", func(t *testing.T) {
+		record := map[string]interface{}{"msg": "hello", "password": "secret", "host": "original"}
+		now := time.Now()
+
+		filters := []fluent.Filter{
+			fluent.AddFields(map[string]interface{}{"host": "web1", "env": "prod"}),
+			fluent.RemoveKeys("password"),
+			fluent.RenameKeys(map[string]string{"msg": "message"}),
+			fluent.RewriteTag(regexp.MustCompile(`^app\.(.*)$`), "service.$1"),
+		}
+		tag, ts, v := "app.web", now, interface{}(record)
+		for _, f := range filters {
+			var ok bool
+			tag, ts, v, ok = f(tag, ts, v)
+			if !assert.True(t, ok, `built-in filters should not drop records`) {
+				return
+			}
+		}
+
+		if !assert.Equal(t, "service.web", tag, `tag should be rewritten`) {
+			return
+		}
+		if !assert.Equal(t, now, ts, `time should be untouched`) {
+			return
+		}
+		expected := map[string]interface{}{"message": "hello", "host": "original", "env": "prod"}
+		if !assert.Equal(t, expected, v, `record should be filtered`) {
+			return
+		}
+		if !assert.Len(t, record, 3, `original record should not be modified`) {
+			return
+		}
+	})
+
+	t.Run("pipeline", func(t *testing.T) {
+		s := newMultiConnServer(t)
+		dropHealthChecks := func(tag string, t time.Time, record interface{}) (string, time.Time, interface{}, bool) {
+			return tag, t, record, tag != "health"
+		}
+		client, err := fluent.NewUnbuffered(
+			fluent.WithAddress(s.listener.Addr().String()),
+			fluent.WithFilters(dropHealthChecks),
+			fluent.WithFilters(fluent.RewriteTag(regexp.MustCompile(`^web$`), "app.web")),
+		)
+		if !assert.NoError(t, err, `NewUnbuffered should succeed`) {
+			return
+		}
+		defer client.Close()
+
+		for _, tag := range []string{"health", "web", "health", "web"} {
+			if !assert.NoError(t, client.Post(tag, map[string]interface{}{"seq": 1}), `Post should succeed`) {
+				return
+			}
+		}
+
+		records := s.Records(2)
+		if !assert.Len(t, records, 2, `health checks should be dropped`) {
+			return
+		}
+		for _, r := range records {
+			if !assert.Equal(t, "app.web", r.tag, `tag should be rewritten`) {
+				return
+			}
+		}
+	})
+}
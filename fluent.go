@@ -6,16 +6,26 @@ package fluent
 // `WithBuffered(true)` (default) creates a buffered client, and
 // `WithBuffered(false)` creates a unbuffered client.
 // All options are delegates to `NewBuffered` and `NewUnbuffered`
-// respectively.
+// respectively. If `WithConsole` is specified, a ConsoleClient is
+// created by `NewConsole` instead.
 func New(options ...Option) (Client, error) {
 	var buffered = true
+	var console bool
 	for _, opt := range options {
 		switch opt.Name() {
 		case optkeyBuffered:
-			buffered = opt.Value().(bool)
+			// the type is checked by the respective constructors
+			if b, ok := opt.Value().(bool); ok {
+				buffered = b
+			}
+		case optkeyConsole:
+			console = true
 		}
 	}
 
+	if console {
+		return NewConsole(options...)
+	}
 	if buffered {
 		return NewBuffered(options...)
 	}
@@ -3,8 +3,11 @@
 package fluent_test
 
 import (
+	"net"
 	"testing"
+	"time"
 
+	fluent "github.com/Edwardsj/fluent-client"
 	official "github.com/fluent/fluent-logger-golang/fluent"
 	k0kubun "github.com/k0kubun/fluent-logger-go"
 	lestrrat "github.com/lestrrat-go/fluent-client"
@@ -81,3 +84,65 @@ func BenchmarkOfficialJSON(b *testing.B) {
 	}
 	c.Close()
 }
+
+// newSink starts a local server that drains its connections, sleeping
+// for delay after each read, so that we can see how much a slow network
+// affects Post() callers
+func newSink(b *testing.B, delay time.Duration) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("failed to listen: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				buf := make([]byte, 4096)
+				for {
+					if _, err := conn.Read(buf); err != nil {
+						return
+					}
+					time.Sleep(delay)
+				}
+			}(conn)
+		}
+	}()
+	return l
+}
+
+// BenchmarkSlowSink compares Post() against a fast and a slow sink. As
+// the writer does not hold the buffer lock while writing, Post() callers
+// should not be slowed down by the sink, and both variants should
+// perform about the same
+func BenchmarkSlowSink(b *testing.B) {
+	variants := []struct {
+		name  string
+		delay time.Duration
+	}{
+		{name: "fast sink", delay: 0},
+		{name: "slow sink", delay: time.Millisecond},
+	}
+	for _, v := range variants {
+		b.Run(v.name, func(b *testing.B) {
+			l := newSink(b, v.delay)
+			defer l.Close()
+
+			c, err := fluent.New(fluent.WithAddress(l.Addr().String()))
+			if err != nil {
+				b.Fatalf("failed to create client: %s", err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < postsPerIter; j++ {
+					c.Post(tag, map[string]interface{}{"count": j})
+				}
+			}
+			b.StopTimer()
+			c.Close()
+		})
+	}
+}
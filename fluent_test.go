@@ -7,10 +7,13 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -705,3 +708,286 @@ func TestPing(t *testing.T) {
 		})
 	}
 }
+
+type customOption struct{}
+
+func (customOption) Name() string       { return "custom" }
+func (customOption) Value() interface{} { return nil }
+
+func TestOptionValidation(t *testing.T) {
+	t.Run("human readable buffer limit", func(t *testing.T) {
+		client, err := fluent.New(fluent.WithBufferLimit("8MB"))
+		if !assert.NoError(t, err, `fluent.New should succeed`) {
+			return
+		}
+		client.Close()
+	})
+
+	var testcases = []struct {
+		Name       string
+		Buffered   bool
+		Options    []fluent.Option
+		Invalid    int
+		Unknown    int
+		Misapplied int
+	}{
+		{Name: "malformed size", Buffered: true, Options: []fluent.Option{fluent.WithBufferLimit("lots")}, Invalid: 1},
+		{Name: "wrong type", Buffered: true, Options: []fluent.Option{fluent.WithBufferLimit(1.5)}, Invalid: 1},
+		{Name: "negative size", Buffered: true, Options: []fluent.Option{fluent.WithBufferLimit(-1)}, Invalid: 1},
+		{Name: "unknown method", Buffered: true, Options: []fluent.Option{fluent.WithMethod("udp")}, Invalid: 1},
+		{Name: "zero dial timeout", Buffered: false, Options: []fluent.Option{fluent.WithDialTimeout(0)}, Invalid: 1},
+		{Name: "buffer limit on unbuffered", Buffered: false, Options: []fluent.Option{fluent.WithBufferLimit(1024)}, Misapplied: 1},
+		{Name: "post option on constructor", Buffered: true, Options: []fluent.Option{fluent.WithSyncAppend(true)}, Misapplied: 1},
+		{
+			Name:     "multiple problems",
+			Buffered: true,
+			Options: []fluent.Option{
+				fluent.WithNetwork("udp"),
+				fluent.WithWriteThreshold(-1),
+				fluent.WithTimestamp(time.Now()),
+				customOption{},
+			},
+			Invalid:    2,
+			Unknown:    1,
+			Misapplied: 1,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.Name, func(t *testing.T) {
+			client, err := fluent.New(append([]fluent.Option{fluent.WithBuffered(tc.Buffered)}, tc.Options...)...)
+			if !assert.Error(t, err, `fluent.New should fail`) {
+				client.Close()
+				return
+			}
+
+			oerr, ok := err.(*fluent.OptionError)
+			if !assert.True(t, ok, `error should be a *fluent.OptionError`) {
+				return
+			}
+			if !assert.Len(t, oerr.Invalid, tc.Invalid, `invalid options`) {
+				return
+			}
+			if !assert.Len(t, oerr.Unknown, tc.Unknown, `unknown options`) {
+				return
+			}
+			if !assert.Len(t, oerr.Misapplied, tc.Misapplied, `misapplied options`) {
+				return
+			}
+		})
+	}
+}
+
+func TestConnMaxLifetime(t *testing.T) {
+	s, err := newServer(false)
+	if !assert.NoError(t, err, "newServer should succeed") {
+		return
+	}
+	defer s.Close()
+
+	sctx, scancel := context.WithCancel(context.Background())
+	defer scancel()
+	go s.Run(sctx)
+	<-s.Ready()
+
+	dials := make(chan string, 8)
+	dialer := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials <- address
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}
+
+	client, err := fluent.New(
+		fluent.WithNetwork(s.Network),
+		fluent.WithAddress(s.Address),
+		fluent.WithDialer(dialer),
+		fluent.WithConnMaxLifetime(50*time.Millisecond),
+		fluent.WithWriteThreshold(0),
+	)
+	if !assert.NoError(t, err, `fluent.New should succeed`) {
+		return
+	}
+	defer client.Shutdown(nil)
+
+	for i := 0; i < 2; i++ {
+		if !assert.NoError(t, client.Post("lifetime", map[string]interface{}{"i": i}, fluent.WithSyncAppend(true)), `Post should succeed`) {
+			return
+		}
+		select {
+		case <-dials:
+		case <-time.After(5 * time.Second):
+			t.Errorf(`timed out waiting for connection %d`, i+1)
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// slowConn is a net.Conn whose writes take a while, so that records
+// pile up while the client writes
+type slowConn struct {
+	net.Conn
+	delay time.Duration
+}
+
+func (c *slowConn) Write(b []byte) (int, error) {
+	time.Sleep(c.delay)
+	return c.Conn.Write(b)
+}
+
+func TestConnMaxLifetimeUnderLoad(t *testing.T) {
+	s := newMultiConnServer(t)
+	defer s.listener.Close()
+
+	var dials int32
+	dialer := func(ctx context.Context, network, address string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return &slowConn{Conn: conn, delay: 20 * time.Millisecond}, nil
+	}
+
+	client, err := fluent.New(
+		fluent.WithAddress(s.listener.Addr().String()),
+		fluent.WithDialer(dialer),
+		fluent.WithConnMaxLifetime(50*time.Millisecond),
+		fluent.WithWriteThreshold(0),
+		fluent.WithChunkSizeLimit(64),
+	)
+	if !assert.NoError(t, err, `fluent.New should succeed`) {
+		return
+	}
+	defer client.Close()
+
+	// keep the writer busy, so that it never waits for records
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			client.Post("load", map[string]interface{}{"seq": i})
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+
+	// well before the write timeout, which would also cause a reconnect
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&dials) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !assert.True(t, atomic.LoadInt32(&dials) >= 2, `the connection should be replaced while records keep coming`) {
+		return
+	}
+}
+
+func TestShutdownUndelivered(t *testing.T) {
+	record := map[string]interface{}{"message": "undelivered"}
+
+	for _, timeout := range []bool{false, true} {
+		timeout := timeout
+		t.Run(fmt.Sprintf("timeout=%t", timeout), func(t *testing.T) {
+			var delay time.Duration
+			shutdownTimeout := 10 * time.Second
+			if timeout {
+				delay = 500 * time.Millisecond
+				shutdownTimeout = 100 * time.Millisecond
+			}
+
+			// the dialer never succeeds, and may take a while to say so
+			dialer := func(ctx context.Context, network, address string) (net.Conn, error) {
+				time.Sleep(delay)
+				return nil, errors.New(`unreachable`)
+			}
+
+			client, err := fluent.New(
+				fluent.WithAddress("127.0.0.1:1"),
+				fluent.WithDialer(dialer),
+				fluent.WithMaxConnAttempts(1),
+				fluent.WithWriteThreshold(1024*1024),
+			)
+			if !assert.NoError(t, err, `fluent.New should succeed`) {
+				return
+			}
+			for i := 0; i < 3; i++ {
+				if !assert.NoError(t, client.Post("undelivered", record, fluent.WithSyncAppend(true)), `Post should succeed`) {
+					return
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			err = client.Shutdown(ctx)
+			undelivered, ok := err.(*fluent.UndeliveredError)
+			if !assert.True(t, ok, `Shutdown should return *UndeliveredError (got %v)`, err) {
+				return
+			}
+			if !assert.Equal(t, 3, undelivered.PendingRecords, `all records should be pending`) {
+				return
+			}
+			if !assert.True(t, undelivered.PendingBytes > 0, `pending bytes should be reported`) {
+				return
+			}
+			if timeout {
+				if !assert.Equal(t, context.DeadlineExceeded, undelivered.Err, `context error should be reported`) {
+					return
+				}
+			} else {
+				if !assert.NoError(t, undelivered.Err, `there should be no context error`) {
+					return
+				}
+			}
+		})
+	}
+}
+
+func TestShutdownUndeliveredHTTP(t *testing.T) {
+	// the endpoint fails every post, once released
+	release := make(chan struct{})
+	received := make(chan struct{}, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	client, err := fluent.New(
+		fluent.WithMethod("http"),
+		fluent.WithAddress(srv.URL),
+	)
+	if !assert.NoError(t, err, `fluent.New should succeed`) {
+		return
+	}
+	if !assert.NoError(t, client.Post("undelivered", map[string]interface{}{"message": "undelivered"}), `Post should succeed`) {
+		return
+	}
+
+	// close the client while the post is in flight, so that it fails
+	// after the queue has been closed
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Errorf(`timed out waiting for the post`)
+		return
+	}
+	client.Close()
+	close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = client.Shutdown(ctx)
+	undelivered, ok := err.(*fluent.UndeliveredError)
+	if !assert.True(t, ok, `Shutdown should return *UndeliveredError (got %v)`, err) {
+		return
+	}
+	if !assert.Equal(t, 1, undelivered.HTTPRecords, `the failed record should be reported`) {
+		return
+	}
+}
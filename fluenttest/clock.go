@@ -0,0 +1,175 @@
+package fluenttest
+
+import (
+	"sync"
+	"time"
+
+	fluent "github.com/Edwardsj/fluent-client"
+	"github.com/pkg/errors"
+)
+
+// Clock is a fluent.Clock whose time only changes when Add or Set is
+// called. Pass it to fluent.WithClock to make timestamps, expiry and
+// periodic tasks deterministic
+type Clock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*clockTimer
+	added  chan struct{} // closed and replaced whenever a timer is created
+}
+
+type clockTicker struct {
+	*clockTimer
+}
+
+type clockTimer struct {
+	clock  *Clock
+	c      chan time.Time
+	when   time.Time
+	period time.Duration // zero for timers
+}
+
+// NewClock creates a new Clock set to t
+func NewClock(t time.Time) *Clock {
+	return &Clock{
+		now:   t,
+		added: make(chan struct{}),
+	}
+}
+
+// Now returns the current time of the clock
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer creates a timer that fires once the clock has been advanced
+// by d
+func (c *Clock) NewTimer(d time.Duration) fluent.Timer {
+	return c.addTimer(d, 0)
+}
+
+// NewTicker creates a ticker that fires every time the clock has been
+// advanced by d
+func (c *Clock) NewTicker(d time.Duration) fluent.Ticker {
+	if d <= 0 {
+		panic(`non-positive interval for NewTicker`)
+	}
+	return clockTicker{c.addTimer(d, d)}
+}
+
+func (c *Clock) addTimer(d, period time.Duration) *clockTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &clockTimer{
+		clock:  c,
+		c:      make(chan time.Time, 1),
+		when:   c.now.Add(d),
+		period: period,
+	}
+	c.timers = append(c.timers, t)
+	close(c.added)
+	c.added = make(chan struct{})
+	return t
+}
+
+// Add advances the clock by d, firing the timers and tickers that are
+// due along the way, in order
+func (c *Clock) Add(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// Set advances the clock to t, firing the timers and tickers that are
+// due along the way, in order. The clock never goes back in time
+func (c *Clock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		next := -1
+		for i, timer := range c.timers {
+			if !timer.when.After(t) && (next < 0 || timer.when.Before(c.timers[next].when)) {
+				next = i
+			}
+		}
+		if next < 0 {
+			break
+		}
+
+		timer := c.timers[next]
+		if timer.when.After(c.now) {
+			c.now = timer.when
+		}
+		// like time.Ticker, ticks are dropped for slow receivers
+		select {
+		case timer.c <- c.now:
+		default:
+		}
+		if timer.period > 0 {
+			timer.when = timer.when.Add(timer.period)
+		} else {
+			c.timers = append(c.timers[:next], c.timers[next+1:]...)
+		}
+	}
+	if t.After(c.now) {
+		c.now = t
+	}
+}
+
+// Timers returns the number of active timers and tickers
+func (c *Clock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// WaitForTimers waits until at least n timers and tickers are active, e.g.
+// until a goroutine has started waiting, before advancing the clock. An
+// error is returned if this does not happen within timeout (measured by
+// the system clock)
+func (c *Clock) WaitForTimers(timeout time.Duration, n int) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		c.mu.Lock()
+		count := len(c.timers)
+		added := c.added
+		c.mu.Unlock()
+
+		if count >= n {
+			return nil
+		}
+		select {
+		case <-added:
+		case <-timer.C:
+			return errors.New(`timed out waiting for timers`)
+		}
+	}
+}
+
+func (t *clockTimer) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop stops the timer. Returns false if it had already fired or been
+// stopped
+func (t *clockTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, timer := range c.timers {
+		if timer == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t clockTicker) Stop() {
+	t.clockTimer.Stop()
+}
@@ -0,0 +1,48 @@
+package fluenttest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Edwardsj/fluent-client/fluenttest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClock(t *testing.T) {
+	start := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := fluenttest.NewClock(start)
+
+	timer := clock.NewTimer(time.Minute)
+	stopped := clock.NewTimer(time.Minute)
+	ticker := clock.NewTicker(10 * time.Second)
+	if !assert.True(t, stopped.Stop(), `Stop should stop a pending timer`) {
+		return
+	}
+
+	clock.Add(30 * time.Second)
+	select {
+	case <-timer.C():
+		t.Errorf(`timer should not fire early`)
+		return
+	case now := <-ticker.C():
+		if !assert.Equal(t, start.Add(10*time.Second), now, `first tick should be at its due time`) {
+			return
+		}
+	}
+
+	clock.Add(30 * time.Second)
+	if !assert.Equal(t, start.Add(time.Minute), <-timer.C(), `timer should fire at its due time`) {
+		return
+	}
+	if !assert.Equal(t, start.Add(time.Minute), clock.Now(), `clock should have advanced`) {
+		return
+	}
+	if !assert.False(t, timer.Stop(), `Stop should report a fired timer`) {
+		return
+	}
+
+	ticker.Stop()
+	if !assert.Equal(t, 0, clock.Timers(), `no timers should be left`) {
+		return
+	}
+}
@@ -0,0 +1,270 @@
+package fluenttest
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	fluent "github.com/Edwardsj/fluent-client"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrInjected is returned by writes that fail because of
+	// Faults.FailAfter, and by dials rejected by a Dialer
+	ErrInjected = errors.New(`injected failure`)
+
+	// ErrRemoteClosed is returned by writes after the remote end has
+	// closed the connection because of Faults.CloseAfter
+	ErrRemoteClosed = errors.New(`connection closed by remote end`)
+)
+
+// Faults describes the faults injected into a connection. The zero value
+// injects none
+type Faults struct {
+	// FailAfter makes writes fail with ErrInjected once this many bytes
+	// have been written. The connection itself stays open
+	FailAfter int
+	// CloseAfter makes the remote end close the connection once this many
+	// bytes have been written: reads return io.EOF, and writes fail with
+	// ErrRemoteClosed
+	CloseAfter int
+	// MaxWrite limits the number of bytes written by each call to Write,
+	// which then returns a short count without an error
+	MaxWrite int
+	// Stall makes writes block until the write deadline passes, or the
+	// connection is closed
+	Stall bool
+}
+
+// Conn is a net.Conn that injects faults into another connection
+type Conn struct {
+	net.Conn
+	faults Faults
+
+	mu            sync.Mutex
+	written       int
+	writeDeadline time.Time
+	remoteClosed  bool
+	closed        chan struct{}
+	closeOnce     sync.Once
+}
+
+// NewConn wraps conn, injecting the given faults
+func NewConn(conn net.Conn, faults Faults) *Conn {
+	return &Conn{
+		Conn:   conn,
+		faults: faults,
+		closed: make(chan struct{}),
+	}
+}
+
+// Written returns the number of bytes that have been written to the
+// underlying connection
+func (c *Conn) Written() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.written
+}
+
+// CloseRemote simulates the remote end closing the connection
+func (c *Conn) CloseRemote() {
+	c.mu.Lock()
+	c.remoteClosed = true
+	c.mu.Unlock()
+	c.Conn.Close()
+}
+
+// Read reads from the underlying connection. io.EOF is returned once the
+// remote end has closed the connection
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		c.mu.Lock()
+		remoteClosed := c.remoteClosed
+		c.mu.Unlock()
+		if remoteClosed {
+			return n, io.EOF
+		}
+	}
+	return n, err
+}
+
+// Write writes to the underlying connection, injecting faults
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.faults.Stall {
+		return 0, c.stall()
+	}
+
+	c.mu.Lock()
+	if c.remoteClosed {
+		c.mu.Unlock()
+		return 0, ErrRemoteClosed
+	}
+
+	var err error
+	if c.faults.MaxWrite > 0 && len(b) > c.faults.MaxWrite {
+		b = b[:c.faults.MaxWrite]
+	}
+	if limit := c.faults.FailAfter; limit > 0 && c.written+len(b) > limit {
+		b = b[:limit-c.written]
+		err = ErrInjected
+	}
+	if limit := c.faults.CloseAfter; limit > 0 && c.written+len(b) >= limit {
+		b = b[:limit-c.written]
+		err = ErrRemoteClosed
+		c.remoteClosed = true
+	}
+	c.mu.Unlock()
+
+	n, werr := c.Conn.Write(b)
+
+	c.mu.Lock()
+	c.written += n
+	remoteClosed := c.remoteClosed
+	c.mu.Unlock()
+
+	if remoteClosed {
+		c.Conn.Close()
+	}
+	if werr != nil {
+		return n, werr
+	}
+	return n, err
+}
+
+// stall blocks until the write deadline passes, or the connection is
+// closed
+func (c *Conn) stall() error {
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-c.closed:
+		return errors.New(`use of closed connection`)
+	case <-timeout:
+		return &net.OpError{Op: "write", Net: "tcp", Err: errTimeout{}}
+	}
+}
+
+// SetDeadline sets the read and write deadlines
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// Close closes the connection, releasing stalled writes
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+type errTimeout struct{}
+
+func (errTimeout) Error() string   { return `i/o timeout` }
+func (errTimeout) Timeout() bool   { return true }
+func (errTimeout) Temporary() bool { return true }
+
+// Dialer creates connections with injected faults. Pass its Dial method
+// to fluent.WithDialer
+type Dialer struct {
+	dial fluent.DialFunc
+
+	mu      sync.Mutex
+	rejects int
+	faults  []Faults
+	dials   int
+	conns   []*Conn
+}
+
+// NewDialer creates a new Dialer that connects with dial, or with a
+// net.Dialer if dial is nil. Connections are healthy until faults are
+// injected with Reject or Inject
+func NewDialer(dial fluent.DialFunc) *Dialer {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return &Dialer{dial: dial}
+}
+
+// Reject makes the next n dials fail with ErrInjected. A negative n
+// makes every dial fail, until Reject is called again
+func (d *Dialer) Reject(n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rejects = n
+}
+
+// Inject makes the next connections inject the given faults, one entry
+// per connection, in order. Connections after them are healthy
+func (d *Dialer) Inject(faults ...Faults) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.faults = append(d.faults, faults...)
+}
+
+// Dial connects to address, unless the dial is rejected
+func (d *Dialer) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dials++
+	if d.rejects != 0 {
+		if d.rejects > 0 {
+			d.rejects--
+		}
+		d.mu.Unlock()
+		return nil, ErrInjected
+	}
+	d.mu.Unlock()
+
+	conn, err := d.dial(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	// faults are only used up by established connections
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var faults Faults
+	if len(d.faults) > 0 {
+		faults = d.faults[0]
+		d.faults = d.faults[1:]
+	}
+	c := NewConn(conn, faults)
+	d.conns = append(d.conns, c)
+	return c, nil
+}
+
+// Dials returns the number of dials attempted so far, including the
+// rejected ones
+func (d *Dialer) Dials() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dials
+}
+
+// Conns returns the connections established so far
+func (d *Dialer) Conns() []*Conn {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*Conn(nil), d.conns...)
+}
@@ -0,0 +1,245 @@
+// Package fluenttest provides utilities for testing code that posts
+// records through a fluent.Client.
+package fluenttest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	fluent "github.com/Edwardsj/fluent-client"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrClosed is returned by a Recorder after it has been closed. It can
+	// also be given to FailWith, to simulate a client closed elsewhere
+	ErrClosed = errors.New(`client has already been closed`)
+
+	// ErrBufferFull is a buffer full error: fluent.IsBufferFull returns
+	// true for it
+	ErrBufferFull error = bufferFullError{}
+)
+
+type bufferFullError struct{}
+
+func (bufferFullError) BufferFull() bool {
+	return true
+}
+
+func (bufferFullError) Error() string {
+	return `buffer full`
+}
+
+var optkeyTimestamp = fluent.WithTimestamp(time.Time{}).Name()
+
+// Record is a record received by a Recorder
+type Record struct {
+	Tag     string
+	Time    time.Time
+	Record  interface{}
+	Options []fluent.Option
+	// Ping is true if the record was received by Ping instead of Post
+	Ping bool
+}
+
+// Recorder is a fluent.Client that keeps every record in memory, so that
+// tests can check what the code under test has posted.
+type Recorder struct {
+	mu      sync.Mutex
+	records []Record
+	fail    func(tag string, v interface{}) error
+	clock   fluent.Clock
+	closed  bool
+	changed chan struct{} // closed and replaced whenever a record is added
+}
+
+// NewRecorder creates a new Recorder
+func NewRecorder() *Recorder {
+	return &Recorder{
+		changed: make(chan struct{}),
+	}
+}
+
+// FailWith makes Post and Ping return err instead of recording the
+// records, e.g. ErrBufferFull or ErrClosed. A nil err restores the
+// normal behavior
+func (r *Recorder) FailWith(err error) {
+	if err == nil {
+		r.FailFunc(nil)
+		return
+	}
+	r.FailFunc(func(string, interface{}) error { return err })
+}
+
+// FailFunc makes Post and Ping call f for each record, and return its
+// error instead of recording the record if it is not nil. This allows
+// failing only some of the records. A nil f restores the normal behavior
+func (r *Recorder) FailFunc(f func(tag string, v interface{}) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fail = f
+}
+
+// SetClock makes the Recorder take the time of the records posted
+// without fluent.WithTimestamp from c, e.g. a Clock shared with the code
+// under test. A nil c restores the system clock
+func (r *Recorder) SetClock(c fluent.Clock) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clock = c
+}
+
+func (r *Recorder) now() time.Time {
+	r.mu.Lock()
+	c := r.clock
+	r.mu.Unlock()
+	if c == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
+
+// Post records the record. The time is taken from fluent.WithTimestamp,
+// or from the clock given to SetClock (the current time by default)
+func (r *Recorder) Post(tag string, v interface{}, options ...fluent.Option) error {
+	return r.record(false, tag, v, options)
+}
+
+// Ping records the record, like Post, with Ping set to true
+func (r *Recorder) Ping(tag string, v interface{}, options ...fluent.Option) error {
+	return r.record(true, tag, v, options)
+}
+
+func (r *Recorder) record(ping bool, tag string, v interface{}, options []fluent.Option) error {
+	rec := Record{
+		Tag:     tag,
+		Record:  v,
+		Options: options,
+		Ping:    ping,
+	}
+	for _, opt := range options {
+		if opt.Name() == optkeyTimestamp {
+			if t, ok := opt.Value().(time.Time); ok {
+				rec.Time = t
+			}
+		}
+	}
+	if rec.Time.IsZero() {
+		rec.Time = r.now()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return ErrClosed
+	}
+	if r.fail != nil {
+		if err := r.fail(tag, v); err != nil {
+			return err
+		}
+	}
+	r.records = append(r.records, rec)
+	close(r.changed)
+	r.changed = make(chan struct{})
+	return nil
+}
+
+// Close makes further calls to Post and Ping fail with ErrClosed
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return nil
+}
+
+// Shutdown is an alias to Close()
+func (r *Recorder) Shutdown(_ context.Context) error {
+	return r.Close()
+}
+
+// Closed returns true if Close or Shutdown has been called
+func (r *Recorder) Closed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+// Reset removes all records, and reopens the Recorder if it was closed
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = nil
+	r.closed = false
+}
+
+// Records returns a copy of all the records received so far
+func (r *Recorder) Records() []Record {
+	return r.Match(func(Record) bool { return true })
+}
+
+// Match returns the records for which f returns true
+func (r *Recorder) Match(f func(Record) bool) []Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var list []Record
+	for _, rec := range r.records {
+		if f(rec) {
+			list = append(list, rec)
+		}
+	}
+	return list
+}
+
+// Tagged returns the records with the given tag
+func (r *Recorder) Tagged(tag string) []Record {
+	return r.Match(func(rec Record) bool { return rec.Tag == tag })
+}
+
+// Count returns the number of records with the given tag
+func (r *Recorder) Count(tag string) int {
+	return len(r.Tagged(tag))
+}
+
+// WaitFor waits until a record for which f returns true has been
+// received, and returns it. An error is returned if no such record is
+// received within timeout
+func (r *Recorder) WaitFor(timeout time.Duration, f func(Record) bool) (Record, error) {
+	list, err := r.WaitForCount(timeout, 1, f)
+	if err != nil {
+		return Record{}, err
+	}
+	return list[0], nil
+}
+
+// WaitForCount waits until at least n records for which f returns true
+// have been received, and returns them. An error is returned if they
+// are not received within timeout
+func (r *Recorder) WaitForCount(timeout time.Duration, n int, f func(Record) bool) ([]Record, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		r.mu.Lock()
+		changed := r.changed
+		r.mu.Unlock()
+
+		if list := r.Match(f); len(list) >= n {
+			return list, nil
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil, errors.New(`timed out waiting for records`)
+		}
+	}
+}
+
+// WaitForTag waits until at least n records with the given tag have
+// been received, and returns them
+func (r *Recorder) WaitForTag(timeout time.Duration, tag string, n int) ([]Record, error) {
+	return r.WaitForCount(timeout, n, func(rec Record) bool { return rec.Tag == tag })
+}
@@ -0,0 +1,94 @@
+package fluenttest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	fluent "github.com/Edwardsj/fluent-client"
+	"github.com/Edwardsj/fluent-client/fluenttest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecorder(t *testing.T) {
+	r := fluenttest.NewRecorder()
+	var client fluent.Client = r
+
+	ts := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	if !assert.NoError(t, client.Post("app.access", map[string]interface{}{"status": 200}, fluent.WithTimestamp(ts)), `Post should succeed`) {
+		return
+	}
+	if !assert.NoError(t, client.Ping("ping", nil), `Ping should succeed`) {
+		return
+	}
+
+	records := r.Tagged("app.access")
+	if !assert.Len(t, records, 1, `one record should be tagged "app.access"`) {
+		return
+	}
+	if !assert.Equal(t, ts, records[0].Time, `time should be taken from WithTimestamp`) {
+		return
+	}
+	if !assert.True(t, r.Records()[1].Ping, `second record should be a ping`) {
+		return
+	}
+
+	t.Run("WaitFor", func(t *testing.T) {
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			client.Post("app.error", map[string]interface{}{"status": 500})
+		}()
+		rec, err := r.WaitFor(time.Second, func(rec fluenttest.Record) bool {
+			m, ok := rec.Record.(map[string]interface{})
+			return ok && m["status"] == 500
+		})
+		if !assert.NoError(t, err, `WaitFor should succeed`) {
+			return
+		}
+		if !assert.Equal(t, "app.error", rec.Tag, `WaitFor should return the matching record`) {
+			return
+		}
+
+		if _, err := r.WaitForTag(50*time.Millisecond, "app.error", 2); !assert.Error(t, err, `WaitForTag should time out`) {
+			return
+		}
+	})
+
+	t.Run("SetClock", func(t *testing.T) {
+		r := fluenttest.NewRecorder()
+		clock := fluenttest.NewClock(ts)
+		r.SetClock(clock)
+		clock.Add(time.Minute)
+		if !assert.NoError(t, r.Post("app.clock", nil), `Post should succeed`) {
+			return
+		}
+		if !assert.Equal(t, ts.Add(time.Minute), r.Tagged("app.clock")[0].Time, `time should be taken from the clock`) {
+			return
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		count := len(r.Records())
+		r.FailWith(fluenttest.ErrBufferFull)
+		if !assert.True(t, fluent.IsBufferFull(client.Post("app.access", nil)), `Post should fail with a buffer full error`) {
+			return
+		}
+		r.FailWith(nil)
+		if !assert.NoError(t, client.Post("app.access", nil), `Post should succeed again`) {
+			return
+		}
+		if !assert.Len(t, r.Records(), count+1, `failed records should not be recorded`) {
+			return
+		}
+
+		if !assert.NoError(t, client.Shutdown(context.Background()), `Shutdown should succeed`) {
+			return
+		}
+		if !assert.Equal(t, fluenttest.ErrClosed, client.Post("app.access", nil), `Post after Shutdown should fail`) {
+			return
+		}
+		if !assert.Equal(t, 2, r.Count("app.access"), `Count should not include failed records`) {
+			return
+		}
+	})
+}
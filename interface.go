@@ -3,6 +3,7 @@ package fluent
 import (
 	"context"
 	"net"
+	"net/http"
 	"sync"
 	"time"
 )
@@ -30,6 +31,40 @@ const (
 	optkeyMaxHttpPackageSize = "max_http_package_size"
 	optkeyHttpPackageGzip    = "http_package_gzip"
 	optkeyHttpRetries        = "http_retries"
+	optkeyTLSFiles           = "tls_files"
+	optkeyTLSServerName      = "tls_server_name"
+	optkeyTLSMinVersion      = "tls_min_version"
+	optkeyTLSReloadInterval  = "tls_reload_interval"
+	optkeyDialer             = "dialer"
+	optkeySRVLookup          = "srv_lookup"
+	optkeyHostLookup         = "host_lookup"
+	optkeyResolver           = "resolver"
+	optkeyResolveInterval    = "resolve_interval"
+	optkeyConnMaxLifetime    = "conn_max_lifetime"
+	optkeyConnMaxIdle        = "conn_max_idle"
+	optkeyWriterConcurrency  = "writer_concurrency"
+	optkeyShardByTag         = "shard_by_tag"
+	optkeyChunkSizeLimit     = "chunk_size_limit"
+	optkeyChunkLimit         = "chunk_limit"
+	optkeyTagBuffer          = "tag_buffer"
+	optkeyMaxRecordAge       = "max_record_age"
+	optkeyDeadLetter         = "dead_letter"
+	optkeyRateLimit          = "rate_limit"
+	optkeySampling           = "sampling"
+	optkeySuppressionSummary = "suppression_summary"
+	optkeyFilters            = "filters"
+	optkeyRedaction          = "redaction"
+	optkeyFailAfter          = "fail_after"
+	optkeyRecheckInterval    = "recheck_interval"
+	optkeyFileFormat         = "file_format"
+	optkeyFileMaxSize        = "file_max_size"
+	optkeyFileRotateInterval = "file_rotate_interval"
+	optkeyFileMaxBackups     = "file_max_backups"
+	optkeyFileMaxAge         = "file_max_age"
+	optkeyConsole            = "console"
+	optkeyConsoleJSON        = "console_json"
+	optkeyConsoleColor       = "console_color"
+	optkeyClock              = "clock"
 )
 
 type marshaler interface {
@@ -49,31 +84,45 @@ type Client interface {
 // Buffered is a Client that buffers incoming messages, and sends them
 // asynchrnously when it can.
 type Buffered struct {
-	closed       bool
-	minionCancel func()
-	minionDone   chan struct{}
-	minionQueue  chan *Message
-	muClosed     sync.RWMutex
-	pingQueue    chan *Message
-	httpQueue    chan *Message
-	subsecond    bool
-	method       string
+	clock             Clock
+	closed            bool
+	minionCancel      func()
+	minionCloseHTTP   func()
+	minionDone        chan struct{}
+	minionFailing     func() time.Time
+	minionQueue       chan *Message
+	minionStats       func() Stats
+	minionUsage       func() bufferUsage
+	minionUndelivered func() *UndeliveredError
+	muClosed          sync.RWMutex
+	pingQueue         chan *Message
+	httpQueue         chan *Message
+	filters           []Filter
+	limiter           *limiter
+	subsecond         bool
+	method            string
 }
 
 // Unbuffered is a Client that synchronously sends messages.
 type Unbuffered struct {
 	address         string
+	clock           Clock
 	conn            net.Conn
+	dialer          DialFunc
 	dialTimeout     time.Duration
+	filters         []Filter
+	httpClient      *http.Client
+	limiter         *limiter
 	marshaler       marshaler
 	maxConnAttempts uint64
 	mu              sync.RWMutex
 	network         string
 	method          string
+	servers         *serverSet
 	subsecond       bool
 	tagPrefix       string
 	writeTimeout    time.Duration
-	tlsConf         TLSConfig
+	tlsConf         *TLSConfig
 }
 
 // Option is an interface used for providing options to the
@@ -92,6 +141,7 @@ type Message struct {
 	Option    interface{} `msgpack:"option"`
 	subsecond bool        // true if we should include subsecond resolution time
 	replyCh   chan error  // non-nil if caller expects notification for successfully appending to buffer
+	delivery  *Delivery   // non-nil for records posted with PostAsync
 	Next      *Message    //for Message chain
 	End       *Message    //end of Message chain
 	Len       int         //for Message chain
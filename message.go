@@ -40,6 +40,7 @@ func (m *Message) clear() {
 	m.Time = EventTime{}
 	m.Record = nil
 	m.Option = nil
+	m.delivery = nil
 	m.End = nil
 	m.Len = 1
 	m.combined = false
@@ -1,17 +1,22 @@
 package fluent
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"context"
-	"crypto/tls"
+	"encoding/json"
+	"hash/fnv"
 	"io"
 	"net"
 	"net/http"
+	"regexp"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	backoff "github.com/lestrrat-go/backoff"
+	msgpack "github.com/lestrrat-go/msgpack"
 	pdebug "github.com/lestrrat-go/pdebug"
 	"github.com/pkg/errors"
 )
@@ -50,17 +55,25 @@ import (
 // The writer is responsible for connecting to the fluentd host, and reusing
 // that connection.
 //
+// With WithWriterConcurrency, the buffer is split into several lanes, each
+// with its own writer and connection. The reader assigns every message to
+// one lane, either in turn or by a hash of its tag.
+//
 // Once connected, the writer tries to write everything it can, for as long
 // as it can. If the buffer is empty, or the connection is dropped, we
 // start over the write process (without waiting for the wake-up call)
 
 type minion struct {
+	// failingSince is accessed atomically, and must stay 64-bit aligned
+	failingSince       int64
 	address            string
 	backoffPolicy      backoff.Policy
-	buffer             []byte
+	clock              Clock
 	bufferLimit        int
-	cond               *sync.Cond
+	chunkIDs           uint64
+	dialer             DialFunc
 	dialTimeout        time.Duration
+	filters            []Filter
 	done               chan struct{}
 	incoming           chan *Message
 	marshaler          marshaler
@@ -68,87 +81,229 @@ type minion struct {
 	maxHttpPackageSize int
 	httpPackageGzip    bool
 	httpRetries        int
-	muPending          sync.RWMutex
+	httpClient         *http.Client
+	lanes              []*lane
+	limiter            *limiter
+	nextLane           int
 	network            string
 	method             string
-	pending            []byte
 	pingCh             chan *Message
 	httpCh             chan *Message
+	muHTTP             sync.RWMutex
+	httpClosed         bool
 	readerDone         chan struct{}
+	servers            *serverSet
+	shardByTag         bool
+	tagBuffers         []TagBuffer
+	tagPatterns        []*regexp.Regexp
+	maxRecordAge       time.Duration
+	deadLetters        DeadLetterSink
+	muAbandoned        sync.Mutex
+	abandonedRecords   int
+	abandonedBytes     int
+	abandonedHTTP      int
 	tagPrefix          string
 	writeThreshold     int
 	writeTimeout       time.Duration
-	tlsConf            TLSConfig
+	connMaxLifetime    time.Duration
+	connMaxIdle        time.Duration
+	tlsConf            *TLSConfig
 }
 
+// default values of the client options, shared by the constructors and
+// NewConfig
+const (
+	defaultAddress            = "127.0.0.1:24224"
+	defaultBufferLimit        = 8 * 1024 * 1024
+	defaultDialTimeout        = 3 * time.Second
+	defaultMaxConnAttempts    = 64
+	defaultWriteThreshold     = 8 * 1028
+	defaultWriteQueueSize     = 6
+	defaultMaxHttpPackageSize = 10
+	defaultHttpRetries        = 5
+	defaultPingInterval       = 5 * time.Minute
+)
+
 func newMinion(options ...Option) (*minion, error) {
 	m := &minion{
-		address:            "127.0.0.1:24224",
+		address:            defaultAddress,
 		backoffPolicy:      backoff.NewExponential(),
-		bufferLimit:        8 * 1024 * 1024,
-		cond:               sync.NewCond(&sync.Mutex{}),
-		dialTimeout:        3 * time.Second,
+		bufferLimit:        defaultBufferLimit,
+		clock:              systemClock{},
+		dialTimeout:        defaultDialTimeout,
 		done:               make(chan struct{}),
-		maxConnAttempts:    64,
+		maxConnAttempts:    defaultMaxConnAttempts,
 		marshaler:          marshalFunc(msgpackMarshal),
 		network:            "tcp",
 		method:             "forward",
 		pingCh:             make(chan *Message),
 		readerDone:         make(chan struct{}),
-		writeThreshold:     8 * 1028,
+		writeThreshold:     defaultWriteThreshold,
 		writeTimeout:       3 * time.Second,
-		tlsConf:            TLSConfig{Enable: false},
-		maxHttpPackageSize: 10,
+		maxHttpPackageSize: defaultMaxHttpPackageSize,
 		httpPackageGzip:    false,
-		httpRetries:        5,
+		httpRetries:        defaultHttpRetries,
 	}
 
-	var writeQueueSize = 6
+	var writeQueueSize = defaultWriteQueueSize
+	var writerConcurrency = 1
+	var chunkSize = 1024 * 1024
+	var chunkLimit int
 	var connectOnStart bool
+	var tlsOptions []Option
+	var discoveryOptions []Option
+	var limitOptions []Option
+	check := newOptionChecker(`fluent.NewBuffered`)
 	for _, opt := range options {
 		switch opt.Name() {
 		case optkeyNetwork:
-			v := opt.Value().(string)
-			switch v {
-			case "tcp", "unix":
-			default:
-				return nil, errors.Errorf(`invalid network type: %s`, v)
+			if v, ok := check.choice(opt, "tcp", "unix"); ok {
+				m.network = v
 			}
-			m.network = v
 		case optkeyAddress:
-			m.address = opt.Value().(string)
+			if v, ok := check.nonEmptyString(opt); ok {
+				m.address = v
+			}
 		case optkeyBufferLimit:
-			m.bufferLimit = opt.Value().(int)
+			if v, ok := check.sizeValue(opt); ok {
+				m.bufferLimit = v
+			}
 		case optkeyDialTimeout:
-			m.dialTimeout = opt.Value().(time.Duration)
+			if v, ok := check.durationValue(opt); ok {
+				m.dialTimeout = v
+			}
+		case optkeyConnMaxLifetime:
+			if v, ok := check.durationValue(opt); ok {
+				m.connMaxLifetime = v
+			}
+		case optkeyConnMaxIdle:
+			if v, ok := check.durationValue(opt); ok {
+				m.connMaxIdle = v
+			}
 		case optkeyMarshaler:
-			m.marshaler = opt.Value().(marshaler)
+			if v, ok := check.marshalerValue(opt); ok {
+				m.marshaler = v
+			}
 		case optkeyMaxConnAttempts:
-			m.maxConnAttempts = opt.Value().(uint64)
+			if v, ok := check.uint64Value(opt); ok {
+				m.maxConnAttempts = v
+			}
 		case optkeyTagPrefix:
-			m.tagPrefix = opt.Value().(string)
+			if v, ok := check.stringValue(opt); ok {
+				m.tagPrefix = v
+			}
 		case optkeyWriteQueueSize:
-			writeQueueSize = opt.Value().(int)
+			if v, ok := check.intValue(opt, 0); ok {
+				writeQueueSize = v
+			}
 		case optkeyWriteThreshold:
-			m.writeThreshold = opt.Value().(int)
+			if v, ok := check.intValue(opt, 0); ok {
+				m.writeThreshold = v
+			}
 		case optkeyConnectOnStart:
-			connectOnStart = opt.Value().(bool)
-		case optkeyWithTLS:
-			m.tlsConf = TLSConfig{Enable: true, Conf: opt.Value().(tls.Config)}
+			if v, ok := check.boolValue(opt); ok {
+				connectOnStart = v
+			}
 		case optkeyMethod:
-			m.method = opt.Value().(string)
+			if v, ok := check.choice(opt, "forward", "http"); ok {
+				m.method = v
+			}
 		case optkeyMaxHttpPackageSize:
-			m.maxHttpPackageSize = opt.Value().(int)
+			if v, ok := check.intValue(opt, 1); ok {
+				m.maxHttpPackageSize = v
+			}
 		case optkeyHttpPackageGzip:
-			m.httpPackageGzip = opt.Value().(bool)
+			if v, ok := check.boolValue(opt); ok {
+				m.httpPackageGzip = v
+			}
 		case optkeyHttpRetries:
-			m.httpRetries = opt.Value().(int)
+			if v, ok := check.intValue(opt, 0); ok {
+				m.httpRetries = v
+			}
+		case optkeyDialer:
+			if v, ok := check.dialerValue(opt); ok {
+				m.dialer = v
+			}
+		case optkeyClock:
+			if v, ok := check.clockValue(opt); ok {
+				m.clock = v
+				m.backoffPolicy = &clockBackoff{
+					clock:    v,
+					interval: 100 * time.Millisecond,
+					max:      10 * time.Second,
+				}
+			}
+		case optkeyFilters:
+			if v, ok := check.filtersValue(opt); ok {
+				m.filters = append(m.filters, v...)
+			}
+		case optkeyRedaction:
+			if v, ok := check.redactionValue(opt); ok {
+				m.filters = append(m.filters, Redact(v...))
+			}
+		case optkeyWriterConcurrency:
+			if v, ok := check.intValue(opt, 1); ok {
+				writerConcurrency = v
+			}
+		case optkeyChunkSizeLimit:
+			if v, ok := check.sizeValue(opt); ok {
+				chunkSize = v
+			}
+		case optkeyChunkLimit:
+			if v, ok := check.intValue(opt, 0); ok {
+				chunkLimit = v
+			}
+		case optkeyTagBuffer:
+			if v, re, ok := check.tagBufferValue(opt); ok {
+				m.tagBuffers = append(m.tagBuffers, v)
+				m.tagPatterns = append(m.tagPatterns, re)
+			}
+		case optkeyMaxRecordAge:
+			if v, ok := check.durationValue(opt); ok {
+				m.maxRecordAge = v
+			}
+		case optkeyDeadLetter:
+			if v, ok := opt.Value().(DeadLetterSink); ok && v != nil {
+				m.deadLetters = v
+			} else {
+				check.invalid(opt, `expected a non-nil DeadLetterSink, got %T`, opt.Value())
+			}
+		case optkeyShardByTag:
+			if v, ok := check.boolValue(opt); ok {
+				m.shardByTag = v
+			}
+		case optkeyBuffered, optkeySubSecond:
+			// handled by fluent.New and NewBuffered respectively
+			check.boolValue(opt)
+		default:
+			if isTLSOption(opt.Name()) {
+				tlsOptions = append(tlsOptions, opt)
+				continue
+			}
+			if isDiscoveryOption(opt.Name()) {
+				discoveryOptions = append(discoveryOptions, opt)
+				continue
+			}
+			if isLimitOption(opt.Name()) {
+				limitOptions = append(limitOptions, opt)
+				continue
+			}
+			check.reject(opt)
 		}
 	}
+	m.tlsConf = newTLSConfig(check, tlsOptions, m.clock)
+	m.limiter = newLimiter(check, limitOptions, m.clock)
+	if m.method != "http" {
+		m.servers = newServerSet(check, discoveryOptions, m.network, m.address, m.dialTimeout, m.clock)
+	}
+
+	if err := check.result(); err != nil {
+		return nil, err
+	}
 
 	// if requested, connect to the server
 	if connectOnStart {
-		conn, err := dial(context.Background(), m.network, m.address, m.dialTimeout, m.tlsConf)
+		conn, err := m.dial(context.Background())
 		if err != nil {
 			return nil, errors.Wrap(err, `failed to connect on start`)
 		}
@@ -158,17 +313,28 @@ func newMinion(options ...Option) (*minion, error) {
 	//if method is http marshaler must by raw json
 	if m.method == "http" {
 		m.marshaler = marshalFunc(rawJsonMarshal)
+		m.httpClient = newHTTPClient(m.dialer)
 		//TODO we need use go-disruptor instead
 		m.httpCh = make(chan *Message, m.bufferLimit)
 		if pdebug.Enabled {
 			pdebug.Printf("m.httpCh cap %d", cap(m.httpCh))
 		}
 	} else {
-		m.buffer = make([]byte, 0, m.bufferLimit)
-		m.pending = m.buffer
+		// the buffer limit is shared evenly between the writers
+		laneLimit := m.bufferLimit / writerConcurrency
+		if laneLimit < 1 {
+			laneLimit = 1
+		}
+		laneChunkLimit := chunkLimit / writerConcurrency
+		if chunkLimit > 0 && laneChunkLimit < 1 {
+			laneChunkLimit = 1
+		}
+		m.lanes = make([]*lane, writerConcurrency)
+		for i := range m.lanes {
+			m.lanes[i] = newLane(i, laneLimit, chunkSize, laneChunkLimit, &m.chunkIDs, laneClasses(m.tagBuffers, m.maxRecordAge, writerConcurrency), m.clock)
+		}
 		if pdebug.Enabled {
-			pdebug.Printf("m.pending cap %d", cap(m.pending))
-			pdebug.Printf("m.pending len %d", len(m.pending))
+			pdebug.Printf("created %d writer lanes of %d bytes each", writerConcurrency, laneLimit)
 		}
 		m.incoming = make(chan *Message, writeQueueSize)
 	}
@@ -185,9 +351,9 @@ func (m *minion) runReader(ctx context.Context) {
 	}
 
 	defer close(m.readerDone)
-	// Wake up the writer goroutine so that it can detect
+	// Wake up the writer goroutines so that they can detect
 	// cancelation.
-	defer m.cond.Broadcast()
+	defer m.wakeWriters()
 
 	// This goroutine receives the incoming data as fast as
 	// possible, so that the caller to enqueue does not block
@@ -261,10 +427,11 @@ func (m *minion) ping(msg *Message) (err error) {
 	if pdebug.Enabled {
 		pdebug.Printf("Connecting to server for ping...")
 	}
-	conn, err := dial(context.Background(), m.network, m.address, m.dialTimeout, m.tlsConf)
+	conn, err := m.dial(context.Background())
 	if err != nil {
 		return errors.Wrap(err, `failed to connect server for ping`)
 	}
+	defer conn.Close()
 
 	if pdebug.Enabled {
 		pdebug.Printf("Serializing ping message...")
@@ -306,6 +473,7 @@ func (m *minion) http_post(msg *Message) (err error) {
 			if pdebug.Enabled {
 				pdebug.Printf("message (%v) retry too many times , drop it.", msg.Record)
 			}
+			m.deadLetter(msg, DeadLetterRetriesExhausted)
 			releaseMessage(msg)
 			return
 		}
@@ -315,9 +483,26 @@ func (m *minion) http_post(msg *Message) (err error) {
 		}
 
 		msg.retries++
+
+		// the queue may have been closed by Close() in the meantime:
+		// the message will not be retried
+		m.muHTTP.RLock()
+		defer m.muHTTP.RUnlock()
+		if m.httpClosed {
+			if pdebug.Enabled {
+				pdebug.Printf("http queue is closed, drop msg")
+			}
+			m.deadLetter(msg, DeadLetterRetriesExhausted)
+			m.muAbandoned.Lock()
+			m.abandonedHTTP += msg.Len
+			m.muAbandoned.Unlock()
+			releaseMessage(msg)
+			return
+		}
 		select {
 		case m.httpCh <- msg:
 		default:
+			m.deadLetter(msg, DeadLetterBufferFull)
 			releaseMessage(msg)
 			if pdebug.Enabled {
 				pdebug.Printf("http queue is full, drop msg")
@@ -377,9 +562,7 @@ func (m *minion) http_post(msg *Message) (err error) {
 		pdebug.Printf("Posting http message...")
 	}
 
-	client := http.Client{
-		Timeout: 5 * time.Second,
-	}
+	client := m.httpClient
 
 	if m.httpPackageGzip {
 		gzipBuf := new(bytes.Buffer)
@@ -403,6 +586,7 @@ func (m *minion) http_post(msg *Message) (err error) {
 		if err != nil {
 			return errors.Wrap(err, `failed to post http gzip request`)
 		}
+		resp.Body.Close()
 		if resp.StatusCode != 200 {
 			return errors.New("return code is not 200")
 		}
@@ -412,6 +596,7 @@ func (m *minion) http_post(msg *Message) (err error) {
 		if err != nil {
 			return errors.Wrap(err, `failed to post http request`)
 		}
+		resp.Body.Close()
 		if resp.StatusCode != 200 {
 			return errors.New("return code is not 200")
 		}
@@ -447,6 +632,9 @@ func (m *minion) appendMessage(msg *Message) {
 		if msg.replyCh != nil {
 			msg.replyCh <- errors.Wrap(err, `failed to marshal payload`)
 		}
+		if msg.delivery != nil {
+			msg.delivery.fail(errors.Wrap(err, `failed to marshal payload`))
+		}
 		return
 	}
 
@@ -459,29 +647,58 @@ func (m *minion) appendMessage(msg *Message) {
 	//
 	// This is implemented in terms of a defer(), because we want to
 	// wake up the writer regardless of if the buffer is full or not
-	defer m.cond.Broadcast()
-
-	m.muPending.Lock()
-	defer m.muPending.Unlock()
-	isFull := len(m.pending)+len(buf) > m.bufferLimit
+	l := m.pickLane(msg.Tag)
+	defer l.cond.Broadcast()
 
-	if isFull {
+	if pdebug.Enabled {
+		pdebug.Printf("background reader: received %d more bytes, appending to lane %d", len(buf), l.id)
+	}
+	if !l.append(msg.Tag, m.bufferClass(msg.Tag), buf, msg.delivery) {
 		if pdebug.Enabled {
 			pdebug.Printf("background reader: buffer is full")
 		}
+		m.deadLetter(msg, DeadLetterBufferFull)
 		if msg.replyCh != nil {
 			if pdebug.Enabled {
 				pdebug.Printf("background reader: replying error to client")
 			}
 			msg.replyCh <- &bufferFullErrInstance
 		}
+		if msg.delivery != nil {
+			msg.delivery.fail(&bufferFullErrInstance)
+		}
 		return
 	}
+	if msg.delivery != nil {
+		msg.delivery.advance(deliveryAppended)
+	}
+}
 
-	if pdebug.Enabled {
-		pdebug.Printf("background reader: received %d more bytes, appending", len(buf))
+// pickLane chooses the lane a message is appended to. Messages are
+// spread across lanes in turn, unless they are sharded by tag, in which
+// case messages with the same tag always go to the same lane (and hence
+// the same connection), preserving their order.
+// Only called from the reader goroutine
+func (m *minion) pickLane(tag string) *lane {
+	if len(m.lanes) == 1 {
+		return m.lanes[0]
+	}
+
+	if m.shardByTag {
+		h := fnv.New32a()
+		io.WriteString(h, tag)
+		return m.lanes[h.Sum32()%uint32(len(m.lanes))]
+	}
+
+	l := m.lanes[m.nextLane]
+	m.nextLane = (m.nextLane + 1) % len(m.lanes)
+	return l
+}
+
+func (m *minion) wakeWriters() {
+	for _, l := range m.lanes {
+		l.cond.Broadcast()
 	}
-	m.pending = append(m.pending, buf...)
 }
 
 func (m *minion) isReaderDone() bool {
@@ -493,17 +710,37 @@ func (m *minion) isReaderDone() bool {
 	return false
 }
 
+// runWriters starts a writer for each lane, and waits for all of
+// them to exit
+func (m *minion) runWriters(ctx context.Context) {
+	defer close(m.done)
+
+	var wg sync.WaitGroup
+	for _, l := range m.lanes {
+		wg.Add(1)
+		go func(l *lane) {
+			defer wg.Done()
+			m.runWriter(ctx, l)
+		}(l)
+	}
+	wg.Wait()
+}
+
 // This goroutine waits for the receiver goroutine to wake
 // it up. When it's awake, we know that there's at least one
-// piece of data to send to the fluentd server.
-func (m *minion) runWriter(ctx context.Context) {
+// piece of data in its lane to send to the fluentd server.
+func (m *minion) runWriter(ctx context.Context, l *lane) {
 	if pdebug.Enabled {
-		defer pdebug.Printf("background writer: exiting")
+		defer pdebug.Printf("background writer %d: exiting", l.id)
 	}
-	defer close(m.done)
 
 	var conn net.Conn
-	defer func(conn net.Conn) {
+	var acks *ackWaiter
+	// retired connections are closed in the background, once the
+	// records posted with PostAsync have been acknowledged
+	var retiring sync.WaitGroup
+	defer retiring.Wait()
+	defer func() {
 		// Make sure that this connection is closed.
 		if conn != nil {
 			if pdebug.Enabled {
@@ -511,12 +748,45 @@ func (m *minion) runWriter(ctx context.Context) {
 			}
 			conn.Close()
 		}
-	}(conn)
+	}()
 
+	var connectedAt, lastWrite time.Time
+	// under steady load the writer never goes back to waiting, so the
+	// lifetime of the connection is also checked between chunks
+	expired := func() bool {
+		return m.connExpired(connectedAt, time.Time{})
+	}
+	var resume bool
 	for {
-		// Wait for the reader to notify us
-		if err := m.waitPending(ctx); err != nil {
-			return
+		// Wait for the reader to notify us, unless the last flush was
+		// cut short to retire the connection
+		if !resume {
+			if err := l.waitPending(ctx, m.writeThreshold); err != nil {
+				return
+			}
+		}
+		resume = false
+
+		// pending is always flushed up to a chunk boundary, so we are at
+		// a record boundary here: retire the connection if it has been
+		// around (or unused) for too long
+		if conn != nil && m.connExpired(connectedAt, lastWrite) {
+			if pdebug.Enabled {
+				pdebug.Printf("background writer: connection reached its max lifetime/idle time, reconnecting")
+			}
+			// the records posted with PostAsync would fail if the
+			// connection were closed before they are acknowledged, so
+			// wait for them without holding up the writer
+			retiring.Add(1)
+			go func(conn net.Conn, acks *ackWaiter) {
+				defer retiring.Done()
+				if acks != nil {
+					acks.wait(m.writeTimeout)
+				}
+				conn.Close()
+			}(conn, acks)
+			conn = nil
+			acks = nil
 		}
 
 		// if we're not connected, we should do that now.
@@ -545,6 +815,9 @@ func (m *minion) runWriter(ctx context.Context) {
 			}
 
 			conn = m.connect(parentCtx)
+			if conn == nil {
+				m.markFailing()
+			}
 			if pdebug.Enabled {
 				if conn == nil {
 					pdebug.Printf("background writer: failed to connect to %s:%s", m.network, m.address)
@@ -554,32 +827,11 @@ func (m *minion) runWriter(ctx context.Context) {
 			}
 
 			if conn != nil {
-				go func() {
-					defer func() {
-						if err := recover(); err != nil {
-							pdebug.Dump(err)
-						}
-					}()
-					one := make([]byte, 1)
-					if pdebug.Enabled {
-						pdebug.Printf("connection monitor start: connected to %s:%s", m.network, m.address)
-					}
-					for {
-						if _, err := conn.Read(one); err == io.EOF {
-							if pdebug.Enabled {
-								pdebug.Printf("connection closed: error %s connected to %s:%s", err.Error(), m.network, m.address)
-							}
-							conn.SetDeadline(time.Now().Add(-time.Second))
-							conn.Close()
-							return
-						}
-						select {
-						case <-ctx.Done():
-							return
-						default:
-						}
-					}
-				}()
+				connectedAt = m.clock.Now()
+				// the monitor gets its own copy of conn, as the writer
+				// replaces it when reconnecting
+				acks = newAckWaiter()
+				go m.monitorConn(conn, acks)
 				break
 			}
 
@@ -589,6 +841,12 @@ func (m *minion) runWriter(ctx context.Context) {
 					if pdebug.Enabled {
 						pdebug.Printf("background writer: bailing out after failed to connect to %s:%s (%d attempts) under flush mode", m.network, m.address, connAttempts)
 					}
+					chunks := l.drain()
+					m.abandon(chunks)
+					failDeliveries(chunks, errConnectFailed)
+					for _, c := range chunks {
+						m.deadLetterChunk(c, DeadLetterConnectFailed)
+					}
 					return
 				}
 			}
@@ -603,13 +861,23 @@ func (m *minion) runWriter(ctx context.Context) {
 			conn.SetWriteDeadline(time.Now().Add(m.writeTimeout))
 		}
 
-		if err := m.flushPending(conn); err != nil {
+		if err := l.flushPending(conn, acks, expired); err != nil {
+			m.markFailing()
 			conn.Close()
 			conn = nil
+		} else {
+			m.markHealthy()
+			lastWrite = m.clock.Now()
+			resume = l.pendingAvailable(0)
 		}
 
 		if m.isReaderDone() {
-			if !m.pendingAvailable(0) {
+			if !l.pendingAvailable(0) {
+				// give the server a chance to acknowledge the records
+				// posted with PostAsync before closing the connection
+				if acks != nil {
+					acks.wait(m.writeTimeout)
+				}
 				if pdebug.Enabled {
 					pdebug.Printf("background writer: pending buffer is empty, bailing out")
 				}
@@ -619,109 +887,135 @@ func (m *minion) runWriter(ctx context.Context) {
 	}
 }
 
-func (m *minion) waitPending(ctx context.Context) error {
-	// We need to check for ctx.Done() here before getting into
-	// the cond loop, because otherwise we might never be woken
-	// up again
-	select {
-	case <-ctx.Done():
-		return nil
-	default:
+// monitorConn reads from conn until it is closed, by either end. The
+// server only ever sends acknowledgements, for the records posted with
+// PostAsync. They are encoded like the records, in msgpack or JSON
+func (m *minion) monitorConn(conn net.Conn, acks *ackWaiter) {
+	defer func() {
+		if err := recover(); err != nil {
+			pdebug.Dump(err)
+		}
+	}()
+	if pdebug.Enabled {
+		pdebug.Printf("connection monitor start: connected to %s:%s", m.network, m.address)
 	}
 
-	m.cond.L.Lock()
-	defer m.cond.L.Unlock()
-
-	for {
-		if m.pendingAvailable(m.writeThreshold) {
+	// any error (including the writer closing the connection) means
+	// this connection is done
+	r := bufio.NewReader(conn)
+	decode := msgpack.NewDecoder(r).Decode
+	first, err := r.Peek(1)
+	if err == nil && first[0] == '{' {
+		decode = json.NewDecoder(r).Decode
+	}
+	for err == nil {
+		var resp map[string]interface{}
+		if err = decode(&resp); err != nil {
 			break
 		}
-
-		select {
-		case <-ctx.Done():
-			if pdebug.Enabled {
-				pdebug.Printf("background writer: cancel detected")
-			}
-			return nil
-		default:
+		if id, ok := resp["ack"].(string); ok {
+			acks.ack(id)
 		}
-
-		m.cond.Wait()
 	}
-	return nil
-}
 
-func (m *minion) flushPending(conn net.Conn) error {
-	var writeiters int
-	var wrotebytes int
 	if pdebug.Enabled {
-		defer func() {
-			pdebug.Printf("background writer: wrote %d bytes in %d iterations", wrotebytes, writeiters)
-		}()
+		pdebug.Printf("connection closed: error %s connected to %s:%s", err.Error(), m.network, m.address)
 	}
-	for {
-		if pdebug.Enabled {
-			writeiters++
-		}
-		n, err := m.writePending(conn)
-		if pdebug.Enabled {
-			wrotebytes += n
-		}
-
-		if err != nil {
-			return err
-		}
+	conn.SetDeadline(time.Now().Add(-time.Second))
+	conn.Close()
+	acks.close()
+}
 
-		if !m.pendingAvailable(0) {
-			break
-		}
+// closeHTTP closes the queue of the "http" method. Messages that fail
+// to be posted after this are not retried
+func (m *minion) closeHTTP() {
+	m.muHTTP.Lock()
+	defer m.muHTTP.Unlock()
+	if !m.httpClosed {
+		m.httpClosed = true
+		close(m.httpCh)
 	}
-	return nil
 }
 
-func (m *minion) writePending(conn net.Conn) (int, error) {
-	m.muPending.Lock()
-	defer m.muPending.Unlock()
-	if pdebug.Enabled {
-		pdebug.Printf("background writer: attempting to write %d bytes", len(m.pending))
+// abandon records chunks that the writer gave up on, so that Shutdown
+// can report them
+func (m *minion) abandon(chunks []*chunk) {
+	m.muAbandoned.Lock()
+	defer m.muAbandoned.Unlock()
+	for _, c := range chunks {
+		m.abandonedRecords += c.records
+		m.abandonedBytes += len(c.buf)
 	}
+}
 
-	if conn == nil {
-		return 0, errors.New(`conn is nil failed to write data to conn`)
+// undelivered returns what has been abandoned so far, plus whatever is
+// still buffered or queued. nil is returned if there is nothing
+func (m *minion) undelivered() *UndeliveredError {
+	var e UndeliveredError
+	m.muAbandoned.Lock()
+	e.PendingRecords = m.abandonedRecords
+	e.PendingBytes = m.abandonedBytes
+	e.HTTPRecords = m.abandonedHTTP
+	m.muAbandoned.Unlock()
+
+	for _, l := range m.lanes {
+		records, size := l.pending()
+		e.PendingRecords += records
+		e.PendingBytes += size
 	}
+	e.IncomingRecords = len(m.incoming)
+	e.HTTPRecords += len(m.httpCh)
 
-	n, err := conn.Write(m.pending)
-	if err != nil {
-		if pdebug.Enabled {
-			pdebug.Printf("background writer: error while writing: %s", err)
-		}
-		return 0, errors.Wrap(err, `failed to write data to conn`)
-	}
-	m.pending = m.pending[n:]
-	if len(m.pending) == 0 {
-		m.pending = m.buffer[0:0]
+	if e.Records() == 0 {
+		return nil
 	}
+	return &e
+}
 
-	if pdebug.Enabled {
-		pdebug.Printf("m.pending cap %d", cap(m.pending))
-		pdebug.Printf("m.pending len %d", len(m.pending))
-	}
-	return n, nil
+// markFailing records that the writers have started failing to deliver
+// records, unless they already were
+func (m *minion) markFailing() {
+	atomic.CompareAndSwapInt64(&m.failingSince, 0, m.clock.Now().UnixNano())
 }
 
-func (m *minion) pendingAvailable(threshold int) bool {
-	m.muPending.RLock()
-	defer m.muPending.RUnlock()
+// markHealthy records that records are being delivered again
+func (m *minion) markHealthy() {
+	atomic.StoreInt64(&m.failingSince, 0)
+}
 
-	if l := len(m.pending); l > threshold {
-		if pdebug.Enabled {
-			pdebug.Printf("background writer: %d bytes to write", l)
-		}
+// failing returns the time since when the writers have been failing
+func (m *minion) failing() time.Time {
+	if since := atomic.LoadInt64(&m.failingSince); since != 0 {
+		return time.Unix(0, since)
+	}
+	return time.Time{}
+}
+
+// connExpired reports whether a connection established at connectedAt,
+// and last written to at lastWrite, should be replaced
+func (m *minion) connExpired(connectedAt, lastWrite time.Time) bool {
+	now := m.clock.Now()
+	if m.connMaxLifetime > 0 && now.Sub(connectedAt) >= m.connMaxLifetime {
+		return true
+	}
+	if m.connMaxIdle > 0 && !lastWrite.IsZero() && now.Sub(lastWrite) >= m.connMaxIdle {
 		return true
 	}
 	return false
 }
 
+// dial connects to the next server. When server discovery is in use,
+// a failure causes the servers to be looked up again
+func (m *minion) dial(ctx context.Context) (net.Conn, error) {
+	address, serverName := m.servers.pick(ctx, m.address)
+	conn, err := dial(ctx, m.network, address, serverName, m.dialTimeout, m.dialer, m.tlsConf)
+	if err != nil {
+		m.servers.failed(address)
+		return nil, err
+	}
+	return conn, nil
+}
+
 func (m *minion) connect(ctx context.Context) net.Conn {
 	retryCtx, cancel := context.WithTimeout(ctx, m.dialTimeout)
 	defer cancel()
@@ -730,7 +1024,7 @@ func (m *minion) connect(ctx context.Context) net.Conn {
 	defer backoffCancel()
 
 	for {
-		conn, err := dial(ctx, m.network, m.address, m.dialTimeout, m.tlsConf)
+		conn, err := m.dial(ctx)
 		if err == nil {
 			if pdebug.Enabled {
 				pdebug.Printf("connected to server!")
@@ -759,9 +1053,15 @@ func (m *minion) runHTTPWriter(ctx context.Context) {
 	if pdebug.Enabled {
 		defer pdebug.Printf("background http writer: exiting")
 	}
+	defer close(m.done)
 
 	for {
-		msg := <-m.httpCh
+		msg, ok := <-m.httpCh
+		if !ok {
+			// the client has been closed, and everything queued
+			// before that has been posted
+			return
+		}
 		if msg.Len >= m.maxHttpPackageSize {
 			m.http_post(msg)
 			continue
@@ -838,3 +1138,65 @@ func (m *minion) combineMsg(msg *Message) {
 	}
 	return
 }
+
+func (l *lane) waitPending(ctx context.Context, threshold int) error {
+	// We need to check for ctx.Done() here before getting into
+	// the cond loop, because otherwise we might never be woken
+	// up again
+	select {
+	case <-ctx.Done():
+		return nil
+	default:
+	}
+
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+
+	for {
+		if l.pendingAvailable(threshold) {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			if pdebug.Enabled {
+				pdebug.Printf("background writer: cancel detected")
+			}
+			return nil
+		default:
+		}
+
+		l.cond.Wait()
+	}
+	return nil
+}
+
+// flushPending writes the pending chunks to conn, until there are none
+// left or stop returns true between two chunks
+func (l *lane) flushPending(conn net.Conn, acks *ackWaiter, stop func() bool) error {
+	var writeiters int
+	var wrotebytes int
+	if pdebug.Enabled {
+		defer func() {
+			pdebug.Printf("background writer: wrote %d bytes in %d iterations", wrotebytes, writeiters)
+		}()
+	}
+	for {
+		if pdebug.Enabled {
+			writeiters++
+		}
+		n, err := l.writePending(conn, acks)
+		if pdebug.Enabled {
+			wrotebytes += n
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if !l.pendingAvailable(0) || stop() {
+			break
+		}
+	}
+	return nil
+}
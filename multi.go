@@ -0,0 +1,102 @@
+package fluent
+
+import "context"
+
+// FailurePolicy specifies when Multi reports an error
+type FailurePolicy int
+
+const (
+	// FailOnAny reports an error if any of the clients fails. This is
+	// the default
+	FailOnAny FailurePolicy = iota
+	// FailOnAll reports an error only if all of the clients fail, e.g.
+	// while the new destination of a migration is being set up
+	FailOnAll
+)
+
+// Multi is a Client that sends every record to all of the clients it
+// wraps, e.g. to both the old and the new aggregators during a migration.
+// The clients are called one after the other, in order.
+type Multi struct {
+	clients []Client
+	policy  FailurePolicy
+}
+
+// NewMulti creates a new Multi client that sends records to clients,
+// and reports failures according to policy.
+func NewMulti(policy FailurePolicy, clients ...Client) *Multi {
+	return &Multi{
+		clients: clients,
+		policy:  policy,
+	}
+}
+
+// Post posts the record to every client. All of the clients are tried
+// even if some of them fail. If the policy calls for an error and more
+// than one client failed, a MultiError is returned
+func (m *Multi) Post(tag string, v interface{}, options ...Option) error {
+	return m.each(func(c Client) error {
+		return c.Post(tag, v, options...)
+	})
+}
+
+// Ping pings every client. Errors are reported like they are by Post
+func (m *Multi) Ping(tag string, v interface{}, options ...Option) error {
+	return m.each(func(c Client) error {
+		return c.Ping(tag, v, options...)
+	})
+}
+
+func (m *Multi) each(f func(Client) error) error {
+	var errs MultiError
+	for _, c := range m.clients {
+		if err := f(c); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if m.policy == FailOnAll && len(errs) < len(m.clients) {
+		return nil
+	}
+	return errs.errorOrNil()
+}
+
+// Close closes all of the clients
+func (m *Multi) Close() error {
+	var errs MultiError
+	for _, c := range m.clients {
+		if err := c.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs.errorOrNil()
+}
+
+// Shutdown shuts all of the clients down concurrently, and waits for
+// them (or for ctx to be canceled). Unlike Post, every failure is
+// reported regardless of the policy, as it may mean lost records.
+func (m *Multi) Shutdown(ctx context.Context) error {
+	return shutdownAll(ctx, m.clients)
+}
+
+// Stats returns the sum of the statistics of the clients that report
+// them (such as *Buffered). Queues and Chunks list those of every client,
+// one after the other; chunk IDs are only unique within a client.
+func (m *Multi) Stats() Stats {
+	var s Stats
+	for _, c := range m.clients {
+		sc, ok := c.(interface{ Stats() Stats })
+		if !ok {
+			continue
+		}
+		cs := sc.Stats()
+		s.BufferLimit += cs.BufferLimit
+		s.BufferedBytes += cs.BufferedBytes
+		s.Records += cs.Records
+		s.QueuedChunks += cs.QueuedChunks
+		s.DroppedRecords += cs.DroppedRecords
+		s.ExpiredRecords += cs.ExpiredRecords
+		s.Queues = append(s.Queues, cs.Queues...)
+		s.Chunks = append(s.Chunks, cs.Chunks...)
+	}
+	return s
+}
@@ -0,0 +1,92 @@
+package fluent_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	fluent "github.com/Edwardsj/fluent-client"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingClient is a Client whose every call fails
+type failingClient struct{}
+
+func (failingClient) Post(string, interface{}, ...fluent.Option) error {
+	return errors.New(`post failed`)
+}
+
+func (failingClient) Ping(string, interface{}, ...fluent.Option) error {
+	return errors.New(`ping failed`)
+}
+
+func (failingClient) Close() error {
+	return nil
+}
+
+func (failingClient) Shutdown(context.Context) error {
+	return errors.New(`shutdown failed`)
+}
+
+func TestMulti(t *testing.T) {
+	t.Run("FailOnAny", func(t *testing.T) {
+		var a, b tagClient
+		multi := fluent.NewMulti(fluent.FailOnAny, &a, failingClient{}, &b)
+		if !assert.Error(t, multi.Post("tag", nil), `Post should fail`) {
+			return
+		}
+		if !assert.Equal(t, []string{"tag"}, a.Tags(), `first client should receive the record`) {
+			return
+		}
+		if !assert.Equal(t, []string{"tag"}, b.Tags(), `last client should receive the record despite the failure`) {
+			return
+		}
+		if !assert.Error(t, multi.Shutdown(context.Background()), `Shutdown should report the failure`) {
+			return
+		}
+		if !assert.True(t, a.shutdown && b.shutdown, `every client should be shut down`) {
+			return
+		}
+	})
+
+	t.Run("FailOnAll", func(t *testing.T) {
+		var a tagClient
+		multi := fluent.NewMulti(fluent.FailOnAll, &a, failingClient{})
+		if !assert.NoError(t, multi.Post("tag", nil), `Post should succeed while one client works`) {
+			return
+		}
+
+		multi = fluent.NewMulti(fluent.FailOnAll, failingClient{}, failingClient{})
+		err := multi.Post("tag", nil)
+		if !assert.IsType(t, fluent.MultiError{}, err, `Post should report every failure`) {
+			return
+		}
+		if !assert.Len(t, err, 2, `Post should report every failure`) {
+			return
+		}
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		var clients []fluent.Client
+		for i := 0; i < 2; i++ {
+			c, err := fluent.NewBuffered(fluent.WithAddress("127.0.0.1:1"), fluent.WithBufferLimit(1000))
+			if !assert.NoError(t, err, `NewBuffered should succeed`) {
+				return
+			}
+			defer c.Close()
+			clients = append(clients, c)
+		}
+		multi := fluent.NewMulti(fluent.FailOnAny, append(clients, &tagClient{})...)
+		if !assert.NoError(t, multi.Post("tag", map[string]interface{}{"a": 1}, fluent.WithSyncAppend(true)), `Post should succeed`) {
+			return
+		}
+
+		s := multi.Stats()
+		if !assert.Equal(t, 2000, s.BufferLimit, `buffer limits should be summed`) {
+			return
+		}
+		if !assert.Equal(t, 2, s.Records, `records should be summed`) {
+			return
+		}
+	})
+}
@@ -114,6 +114,11 @@ func WithSyncAppend(b bool) Option {
 // would exceed this size, an error is returned (note: you must
 // use `WithSyncAppend` in `Client.Post` if you want this error
 // to be reported). The defalut value is 8MB
+//
+// The value may be an integer number of bytes, or a human readable
+// string such as "512KB" or "8MB" (units are powers of 1024).
+// Any other type, or a non-positive size, causes `NewBuffered`
+// to return an error.
 func WithBufferLimit(v interface{}) Option {
 	return &option{
 		name:  optkeyBufferLimit,
@@ -186,6 +191,54 @@ func WithDialTimeout(d time.Duration) Option {
 	}
 }
 
+// WithConnMaxLifetime specifies the maximum amount of time a connection
+// from the background writer may be reused. Once exceeded, the connection
+// is closed in between writes, and a new one is established. This spreads
+// the load when the servers sit behind a load balancer. By default
+// connections are reused until they fail
+func WithConnMaxLifetime(d time.Duration) Option {
+	return &option{
+		name:  optkeyConnMaxLifetime,
+		value: d,
+	}
+}
+
+// WithConnMaxIdle specifies the maximum amount of time a connection from
+// the background writer may stay unused. An idle connection is replaced
+// by a new one before the next write. By default idle connections are
+// reused
+func WithConnMaxIdle(d time.Duration) Option {
+	return &option{
+		name:  optkeyConnMaxIdle,
+		value: d,
+	}
+}
+
+// WithWriterConcurrency specifies the number of background writers, each
+// with its own connection to the server. Messages are spread across the
+// writers in turn (see WithShardByTag), and the buffer limit is divided
+// evenly between them. The default value is 1
+func WithWriterConcurrency(n int) Option {
+	return &option{
+		name:  optkeyWriterConcurrency,
+		value: n,
+	}
+}
+
+// WithShardByTag specifies that messages should be assigned to the
+// writers specified by WithWriterConcurrency according to a hash of
+// their tag, so that messages with the same tag are written over the
+// same connection, in order. As the buffer limit (and the limit of each
+// TagBuffer) is divided between the writers, the records of a single
+// tag can then only use one writer's share of it. By default this
+// feature is turned OFF.
+func WithShardByTag(b bool) Option {
+	return &option{
+		name:  optkeyShardByTag,
+		value: b,
+	}
+}
+
 // WithWriteQueueSize specifies the channel buffer size for the queue
 // used to pass messages from the Client to the background writer
 // goroutines. The default value is 64.
@@ -11,10 +11,12 @@ import (
 // By default a ping message will be sent every 5 minutes. You may change this
 // using the WithPingInterval option.
 //
-// If you need to capture ping failures, pass it a channel using WithPingResultChan
+// If you need to capture ping failures, pass it a channel using WithPingResultChan.
+// The interval is measured by the Clock given with WithClock, if any.
 func Ping(ctx context.Context, client Client, tag string, record interface{}, options ...Option) {
-	var interval = 5 * time.Minute
+	var interval = defaultPingInterval
 	var replyCh chan error
+	var clock Clock = systemClock{}
 
 	for _, option := range options {
 		switch option.Name() {
@@ -22,17 +24,19 @@ func Ping(ctx context.Context, client Client, tag string, record interface{}, op
 			interval = option.Value().(time.Duration)
 		case optkeyPingResultChan:
 			replyCh = option.Value().(chan error)
+		case optkeyClock:
+			clock = option.Value().(Clock)
 		}
 	}
 
-	ticker := time.NewTicker(interval)
+	ticker := clock.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
+		case <-ticker.C():
 			err := client.Ping(tag, record, options...)
 			if err != nil && replyCh != nil {
 				replyCh <- err
@@ -0,0 +1,185 @@
+package fluent
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/proxy"
+)
+
+// DialFunc is the function used to establish connections to the
+// server. It has the same signature as net.Dialer.DialContext
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// WithDialer specifies the function used to connect to the server,
+// both for forward connections and pings, and for the HTTP transport
+// when the "http" method is in use. The context passed to the function
+// carries the dial timeout (see WithDialTimeout).
+//
+// Use NewSOCKS5Dialer or NewHTTPConnectDialer to go through a proxy.
+func WithDialer(f DialFunc) Option {
+	return &option{
+		name:  optkeyDialer,
+		value: f,
+	}
+}
+
+func defaultDialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+	}
+}
+
+// newHTTPClient creates the http.Client used by the "http" method.
+// If dialFunc is nil, the default transport is used. Otherwise the
+// default transport's settings are kept, and only the dialer is replaced
+func newHTTPClient(dialFunc DialFunc) *http.Client {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+	}
+	if dialFunc != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = dialFunc
+		client.Transport = transport
+	}
+	return client
+}
+
+// NewSOCKS5Dialer creates a DialFunc that connects to the server through
+// the SOCKS5 proxy at proxyAddress ("host:port"). If username is not
+// empty, username/password authentication is used.
+func NewSOCKS5Dialer(proxyAddress, username, password string) (DialFunc, error) {
+	var auth *proxy.Auth
+	if username != "" {
+		auth = &proxy.Auth{User: username, Password: password}
+	}
+
+	d, err := proxy.SOCKS5("tcp", proxyAddress, auth, defaultDialer(0))
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to create SOCKS5 dialer`)
+	}
+
+	cd, ok := d.(proxy.ContextDialer)
+	if !ok {
+		return nil, errors.New(`SOCKS5 dialer does not support contexts`)
+	}
+	return cd.DialContext, nil
+}
+
+// NewHTTPConnectDialer creates a DialFunc that connects to the server
+// through an HTTP proxy using the CONNECT method. proxyURL is of the form
+// "http://[user:password@]host:port"; credentials are sent using basic
+// authentication.
+func NewHTTPConnectDialer(proxyURL string) (DialFunc, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to parse proxy URL`)
+	}
+	if u.Scheme != "http" {
+		return nil, errors.Errorf(`unsupported proxy scheme %q (expected "http")`, u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.Errorf(`proxy URL %q has no host`, proxyURL)
+	}
+
+	var authorization string
+	if u.User != nil {
+		password, _ := u.User.Password()
+		authorization = `Basic ` + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+`:`+password))
+	}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		return httpConnect(ctx, u.Host, authorization, network, address)
+	}, nil
+}
+
+func httpConnect(ctx context.Context, proxyAddress, authorization, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, errors.Errorf(`HTTP CONNECT proxies only support tcp, got %q`, network)
+	}
+
+	conn, err := defaultDialer(0).DialContext(ctx, "tcp", proxyAddress)
+	if err != nil {
+		return nil, errors.Wrap(err, `failed to connect to HTTP proxy`)
+	}
+
+	// the CONNECT exchange should not outlive the context
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now().Add(-time.Second))
+		case <-stop:
+		}
+	}()
+	var once sync.Once
+	stopWatching := func() {
+		once.Do(func() {
+			close(stop)
+			<-stopped
+		})
+	}
+	defer stopWatching()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if authorization != "" {
+		req.Header.Set("Proxy-Authorization", authorization)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, `failed to send CONNECT request`)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	stopWatching()
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, errors.Wrap(ctx.Err(), `CONNECT request canceled`)
+		}
+		return nil, errors.Wrap(err, `failed to read CONNECT response`)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.Errorf(`HTTP proxy refused to connect to %s: %s`, address, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		// the proxy already sent data from the server; make sure we
+		// do not lose it
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,160 @@
+package fluent_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	fluent "github.com/Edwardsj/fluent-client"
+	msgpack "github.com/lestrrat-go/msgpack"
+	"github.com/stretchr/testify/assert"
+)
+
+// connectProxy is a minimal HTTP CONNECT proxy
+type connectProxy struct {
+	listener      net.Listener
+	authorization chan string
+}
+
+func newConnectProxy() (*connectProxy, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &connectProxy{listener: l, authorization: make(chan string, 1)}
+	go http.Serve(l, p)
+	return p, nil
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+		return
+	}
+	p.authorization <- r.Header.Get("Proxy-Authorization")
+
+	upstream, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	go func() {
+		io.Copy(upstream, conn)
+		upstream.Close()
+	}()
+	io.Copy(conn, upstream)
+	conn.Close()
+}
+
+func TestHTTPConnectDialer(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err, `net.Listen should succeed`) {
+		return
+	}
+	defer target.Close()
+
+	received := make(chan *fluent.Message, 1)
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var msg fluent.Message
+		if err := msgpack.NewDecoder(conn).Decode(&msg); err == nil {
+			received <- &msg
+		}
+	}()
+
+	p, err := newConnectProxy()
+	if !assert.NoError(t, err, `newConnectProxy should succeed`) {
+		return
+	}
+	defer p.listener.Close()
+
+	dialer, err := fluent.NewHTTPConnectDialer("http://user:secret@" + p.listener.Addr().String())
+	if !assert.NoError(t, err, `NewHTTPConnectDialer should succeed`) {
+		return
+	}
+
+	client, err := fluent.New(
+		fluent.WithBuffered(false),
+		fluent.WithAddress(target.Addr().String()),
+		fluent.WithDialer(dialer),
+	)
+	if !assert.NoError(t, err, `fluent.New should succeed`) {
+		return
+	}
+	defer client.Close()
+
+	if !assert.NoError(t, client.Post("proxy.test", "hello"), `Post should succeed`) {
+		return
+	}
+
+	select {
+	case auth := <-p.authorization:
+		if !assert.Equal(t, "Basic dXNlcjpzZWNyZXQ=", auth, `proxy should receive credentials`) {
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf(`timed out waiting for the proxy`)
+		return
+	}
+
+	select {
+	case msg := <-received:
+		if !assert.Equal(t, "proxy.test", msg.Tag, `server should receive the message through the proxy`) {
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf(`timed out waiting for the message`)
+	}
+}
+
+func TestWithDialer(t *testing.T) {
+	s, err := newServer(false)
+	if !assert.NoError(t, err, "newServer should succeed") {
+		return
+	}
+	defer s.Close()
+
+	sctx, scancel := context.WithCancel(context.Background())
+	defer scancel()
+	go s.Run(sctx)
+	<-s.Ready()
+
+	dials := make(chan string, 8)
+	dialer := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials <- address
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}
+
+	client, err := fluent.New(
+		fluent.WithNetwork(s.Network),
+		fluent.WithAddress(s.Address),
+		fluent.WithDialer(dialer),
+	)
+	if !assert.NoError(t, err, `fluent.New should succeed`) {
+		return
+	}
+	defer client.Shutdown(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !assert.NoError(t, client.Ping("ping", "hello", fluent.WithContext(ctx)), `Ping should succeed`) {
+		return
+	}
+	if !assert.Equal(t, s.Address, <-dials, `Ping should use the custom dialer`) {
+		return
+	}
+}
@@ -0,0 +1,409 @@
+package fluent
+
+import (
+	"math/rand"
+	"regexp"
+	"sync"
+	"time"
+
+	pdebug "github.com/lestrrat-go/pdebug"
+)
+
+// RateLimit limits how many records per second are accepted by Post,
+// using a token bucket. Records over the limit are silently discarded
+// and counted (see Suppressed)
+type RateLimit struct {
+	// Pattern is matched against the tag given to Post, and uses the
+	// same syntax as Route.Pattern, e.g. "debug.**". Each matching tag
+	// gets its own bucket. If empty, the limit applies to all records
+	// combined
+	Pattern string
+	// Rate is the number of records per second that are accepted
+	Rate float64
+	// Burst is the number of records that may be accepted at once,
+	// after a quiet period. The default is 1
+	Burst int
+}
+
+// Sampling keeps only a portion of the records given to Post. Records
+// that are not kept are silently discarded and counted (see Suppressed).
+// Exactly one of Rate and Every must be specified
+type Sampling struct {
+	// Pattern is matched against the tag given to Post, and uses the
+	// same syntax as Route.Pattern. If empty, all records are sampled
+	Pattern string
+	// Rate is the probability, between 0 and 1, that a record is kept
+	Rate float64
+	// Every keeps the first of every Every records of each tag
+	Every int
+}
+
+// OtherTags is the tag under which the limiter tracks the tags seen
+// after the first 1024 distinct ones: they share their rate limit
+// buckets and sampling counters, and are counted together in
+// SuppressionStats.Tags. This keeps a program posting with ever changing
+// tags from growing its memory without bounds
+const OtherTags = "(other)"
+
+const maxLimiterTags = 1024
+
+// SuppressionStats counts the records discarded by WithRateLimit and
+// WithSampling
+type SuppressionStats struct {
+	RateLimited uint64
+	Sampled     uint64
+	// Tags holds the number of discarded records for each tag (see
+	// OtherTags)
+	Tags map[string]uint64
+}
+
+// WithRateLimit limits the rate at which records are accepted by Post,
+// for all records or for the tags matching r.Pattern. May be specified
+// multiple times; a record must pass every limit that applies to it.
+func WithRateLimit(r RateLimit) Option {
+	return &option{
+		name:  optkeyRateLimit,
+		value: r,
+	}
+}
+
+// WithSampling specifies that only a portion of the records, for all
+// tags or for the tags matching s.Pattern, should be accepted by Post.
+// May be specified multiple times. Sampling is applied before rate
+// limits, so discarded records do not use up the rate.
+func WithSampling(s Sampling) Option {
+	return &option{
+		name:  optkeySampling,
+		value: s,
+	}
+}
+
+// WithSuppressionSummary specifies that a record summarizing the records
+// discarded by WithRateLimit and WithSampling should be posted to tag
+// every interval, if any were discarded. The record contains the keys
+// "rate_limited", "sampled" and "tags" (counts per tag). A last summary
+// is posted when the client is closed. Records posted to tag are never
+// discarded.
+func WithSuppressionSummary(tag string, interval time.Duration) Option {
+	return &option{
+		name:  optkeySuppressionSummary,
+		value: suppressionSummary{tag: tag, interval: interval},
+	}
+}
+
+type suppressionSummary struct {
+	tag      string
+	interval time.Duration
+}
+
+func isLimitOption(name string) bool {
+	switch name {
+	case optkeyRateLimit, optkeySampling, optkeySuppressionSummary:
+		return true
+	}
+	return false
+}
+
+type bucketKey struct {
+	rule int
+	tag  string
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket for the time elapsed since the last call, and
+// takes a token if there is one
+func (b *tokenBucket) take(now time.Time, rate, burst float64) bool {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// limiter applies the rate limits and sampling to the records given to
+// Post. A nil *limiter accepts everything
+type limiter struct {
+	limits          []RateLimit
+	limitTags       []*regexp.Regexp
+	samplings       []Sampling
+	samplingTags    []*regexp.Regexp
+	summaryTag      string
+	summaryInterval time.Duration
+	clock           Clock
+
+	mu       sync.Mutex
+	tags     map[string]struct{}
+	buckets  map[bucketKey]*tokenBucket
+	seen     map[bucketKey]uint64
+	rand     *rand.Rand
+	total    SuppressionStats
+	pending  SuppressionStats
+	post     func(string, interface{}) error
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// newLimiter assembles a limiter from the rate limit and sampling options.
+// Problems are recorded in check. Returns nil if no limit was requested
+func newLimiter(check *optionChecker, options []Option, clock Clock) *limiter {
+	l := &limiter{
+		clock:   clock,
+		tags:    make(map[string]struct{}),
+		buckets: make(map[bucketKey]*tokenBucket),
+		seen:    make(map[bucketKey]uint64),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		stopCh:  make(chan struct{}),
+	}
+	for _, opt := range options {
+		switch opt.Name() {
+		case optkeyRateLimit:
+			r, ok := opt.Value().(RateLimit)
+			if !ok {
+				check.invalid(opt, `expected fluent.RateLimit, got %T`, opt.Value())
+				continue
+			}
+			re, err := compileTagMatcher(r.Pattern)
+			if err != nil {
+				check.invalid(opt, `%s`, err)
+				continue
+			}
+			if r.Rate <= 0 {
+				check.invalid(opt, `rate must be positive, got %f`, r.Rate)
+				continue
+			}
+			if r.Burst < 0 {
+				check.invalid(opt, `burst must not be negative, got %d`, r.Burst)
+				continue
+			}
+			if r.Burst == 0 {
+				r.Burst = 1
+			}
+			l.limits = append(l.limits, r)
+			l.limitTags = append(l.limitTags, re)
+		case optkeySampling:
+			s, ok := opt.Value().(Sampling)
+			if !ok {
+				check.invalid(opt, `expected fluent.Sampling, got %T`, opt.Value())
+				continue
+			}
+			re, err := compileTagMatcher(s.Pattern)
+			if err != nil {
+				check.invalid(opt, `%s`, err)
+				continue
+			}
+			switch {
+			case s.Every < 0:
+				check.invalid(opt, `every must not be negative, got %d`, s.Every)
+				continue
+			case s.Every > 0 && s.Rate != 0:
+				check.invalid(opt, `only one of rate and every may be specified`)
+				continue
+			case s.Every == 0 && (s.Rate <= 0 || s.Rate > 1):
+				check.invalid(opt, `rate must be greater than 0 and at most 1, got %f`, s.Rate)
+				continue
+			}
+			l.samplings = append(l.samplings, s)
+			l.samplingTags = append(l.samplingTags, re)
+		case optkeySuppressionSummary:
+			v, ok := opt.Value().(suppressionSummary)
+			if !ok {
+				check.invalid(opt, `expected a value created by fluent.WithSuppressionSummary, got %T`, opt.Value())
+				continue
+			}
+			if v.tag == "" {
+				check.invalid(opt, `summary tag must not be empty`)
+				continue
+			}
+			if v.interval <= 0 {
+				check.invalid(opt, `summary interval must be positive, got %s`, v.interval)
+				continue
+			}
+			l.summaryTag = v.tag
+			l.summaryInterval = v.interval
+		}
+	}
+
+	if len(l.limits) == 0 && len(l.samplings) == 0 {
+		// a summary of nothing
+		for _, opt := range options {
+			if opt.Name() == optkeySuppressionSummary {
+				check.reject(opt)
+			}
+		}
+		return nil
+	}
+	return l
+}
+
+// trackedTag returns the tag under which tag is tracked: tag itself,
+// or OtherTags once maxLimiterTags distinct tags have been seen. Must be
+// called with mu held
+func (l *limiter) trackedTag(tag string) string {
+	if _, ok := l.tags[tag]; ok {
+		return tag
+	}
+	if len(l.tags) >= maxLimiterTags {
+		return OtherTags
+	}
+	l.tags[tag] = struct{}{}
+	return tag
+}
+
+// allow reports whether a record for tag should be posted
+func (l *limiter) allow(tag string) bool {
+	if l == nil || (l.summaryTag != "" && tag == l.summaryTag) {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tracked := l.trackedTag(tag)
+	for i, s := range l.samplings {
+		if !matchTag(l.samplingTags[i], tag) {
+			continue
+		}
+		if s.Every > 0 {
+			key := bucketKey{rule: i, tag: tracked}
+			n := l.seen[key]
+			l.seen[key] = n + 1
+			if n%uint64(s.Every) == 0 {
+				continue
+			}
+		} else if l.rand.Float64() < s.Rate {
+			continue
+		}
+		l.suppress(tracked, false)
+		return false
+	}
+
+	now := l.clock.Now()
+	for i, r := range l.limits {
+		key := bucketKey{rule: i}
+		if re := l.limitTags[i]; re != nil {
+			if !re.MatchString(tag) {
+				continue
+			}
+			key.tag = tracked
+		}
+		b, ok := l.buckets[key]
+		if !ok {
+			b = &tokenBucket{tokens: float64(r.Burst), last: now}
+			l.buckets[key] = b
+		}
+		if !b.take(now, r.Rate, float64(r.Burst)) {
+			l.suppress(tracked, true)
+			return false
+		}
+	}
+	return true
+}
+
+// suppress counts a discarded record. Must be called with mu held
+func (l *limiter) suppress(tag string, rateLimited bool) {
+	for _, s := range []*SuppressionStats{&l.total, &l.pending} {
+		if rateLimited {
+			s.RateLimited++
+		} else {
+			s.Sampled++
+		}
+		if s.Tags == nil {
+			s.Tags = make(map[string]uint64)
+		}
+		s.Tags[tag]++
+	}
+}
+
+// suppressed returns a copy of the counters
+func (l *limiter) suppressed() SuppressionStats {
+	if l == nil {
+		return SuppressionStats{}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s := l.total
+	s.Tags = make(map[string]uint64, len(l.total.Tags))
+	for tag, n := range l.total.Tags {
+		s.Tags[tag] = n
+	}
+	return s
+}
+
+// Suppressed returns the number of records discarded so far by
+// WithRateLimit and WithSampling
+func (c *Buffered) Suppressed() SuppressionStats {
+	return c.limiter.suppressed()
+}
+
+// Suppressed returns the number of records discarded so far by
+// WithRateLimit and WithSampling
+func (c *Unbuffered) Suppressed() SuppressionStats {
+	return c.limiter.suppressed()
+}
+
+// start starts posting summaries through post, if requested
+func (l *limiter) start(post func(string, interface{}) error) {
+	if l == nil || l.summaryTag == "" {
+		return
+	}
+	l.post = post
+	go l.runSummary()
+}
+
+func (l *limiter) runSummary() {
+	t := l.clock.NewTicker(l.summaryInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-l.stopCh:
+			return
+		case <-t.C():
+			l.summarize()
+		}
+	}
+}
+
+// summarize posts the counts since the previous summary, if any
+func (l *limiter) summarize() {
+	l.mu.Lock()
+	p := l.pending
+	l.pending = SuppressionStats{}
+	l.mu.Unlock()
+
+	if p.RateLimited+p.Sampled == 0 {
+		return
+	}
+	err := l.post(l.summaryTag, map[string]interface{}{
+		"rate_limited": p.RateLimited,
+		"sampled":      p.Sampled,
+		"tags":         p.Tags,
+	})
+	if err != nil && pdebug.Enabled {
+		pdebug.Printf("limiter: failed to post summary: %s", err)
+	}
+}
+
+// stop stops posting summaries, after posting a last one
+func (l *limiter) stop() {
+	if l == nil {
+		return
+	}
+	l.stopOnce.Do(func() {
+		close(l.stopCh)
+		if l.post != nil {
+			l.summarize()
+		}
+	})
+}
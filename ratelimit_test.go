@@ -0,0 +1,118 @@
+package fluent_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	fluent "github.com/Edwardsj/fluent-client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimit(t *testing.T) {
+	t.Run("sampling and limits", func(t *testing.T) {
+		client, err := fluent.NewBuffered(
+			fluent.WithAddress("127.0.0.1:1"),
+			fluent.WithSampling(fluent.Sampling{Pattern: "sampled.**", Every: 3}),
+			fluent.WithRateLimit(fluent.RateLimit{Pattern: "limited.{a,b}", Rate: 0.001, Burst: 5}),
+		)
+		if !assert.NoError(t, err, `NewBuffered should succeed`) {
+			return
+		}
+		defer client.Close()
+
+		for i := 0; i < 9; i++ {
+			for _, tag := range []string{"sampled.a", "limited.a", "limited.b", "other"} {
+				if !assert.NoError(t, client.Post(tag, map[string]interface{}{"i": i}), `Post should succeed`) {
+					return
+				}
+			}
+		}
+
+		s := client.Suppressed()
+		if !assert.Equal(t, uint64(6), s.Sampled, `two out of three records should be sampled out`) {
+			return
+		}
+		if !assert.Equal(t, uint64(8), s.RateLimited, `records over the burst should be rate limited`) {
+			return
+		}
+		if !assert.Equal(t, map[string]uint64{"sampled.a": 6, "limited.a": 4, "limited.b": 4}, s.Tags, `each tag should have its own bucket`) {
+			return
+		}
+	})
+
+	t.Run("summary", func(t *testing.T) {
+		s := newMultiConnServer(t)
+		client, err := fluent.NewUnbuffered(
+			fluent.WithAddress(s.listener.Addr().String()),
+			fluent.WithRateLimit(fluent.RateLimit{Rate: 0.001, Burst: 2}),
+			fluent.WithSuppressionSummary("fluent.suppressed", time.Hour),
+		)
+		if !assert.NoError(t, err, `NewUnbuffered should succeed`) {
+			return
+		}
+		for i := 0; i < 5; i++ {
+			if !assert.NoError(t, client.Post("noisy", map[string]interface{}{"seq": i}), `Post should succeed`) {
+				return
+			}
+		}
+		// the last summary is posted on close
+		if !assert.NoError(t, client.Close(), `Close should succeed`) {
+			return
+		}
+
+		records := s.Records(3)
+		if !assert.Len(t, records, 3, `two records and a summary should be received`) {
+			return
+		}
+		if !assert.Equal(t, "fluent.suppressed", records[2].tag, `the summary should be posted to its tag`) {
+			return
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := fluent.New(
+			fluent.WithSampling(fluent.Sampling{Rate: 0.5, Every: 2}),
+			fluent.WithRateLimit(fluent.RateLimit{Rate: 0}),
+			fluent.WithRateLimit(fluent.RateLimit{Pattern: "app.{web", Rate: 1}),
+		)
+		if !assert.IsType(t, &fluent.OptionError{}, err, `invalid limits should be rejected`) {
+			return
+		}
+		if !assert.Len(t, err.(*fluent.OptionError).Invalid, 3, `every option should be reported`) {
+			return
+		}
+
+		_, err = fluent.New(fluent.WithSuppressionSummary("fluent.suppressed", time.Minute))
+		if !assert.IsType(t, &fluent.OptionError{}, err, `a summary without limits should be rejected`) {
+			return
+		}
+		if !assert.Equal(t, []string{"suppression_summary"}, err.(*fluent.OptionError).Misapplied, `the summary should be reported as misapplied`) {
+			return
+		}
+	})
+
+	t.Run("many tags", func(t *testing.T) {
+		client, err := fluent.NewBuffered(
+			fluent.WithAddress("127.0.0.1:1"),
+			fluent.WithRateLimit(fluent.RateLimit{Pattern: "runaway.*", Rate: 0.001, Burst: 1}),
+		)
+		if !assert.NoError(t, err, `NewBuffered should succeed`) {
+			return
+		}
+		defer client.Close()
+
+		for i := 0; i < 3000; i++ {
+			client.Post(fmt.Sprintf("runaway.%d", i), map[string]interface{}{"i": i})
+		}
+
+		s := client.Suppressed()
+		if !assert.Len(t, s.Tags, 1, `only the tags sharing the overflow bucket should be rate limited`) {
+			return
+		}
+		// the first tags have their own bucket, the others share one
+		if !assert.Equal(t, uint64(3000-1024-1), s.Tags[fluent.OtherTags], `overflow tags should be counted together`) {
+			return
+		}
+	})
+}
@@ -0,0 +1,339 @@
+package fluent
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	msgpack "github.com/lestrrat-go/msgpack"
+)
+
+// RedactAction specifies how a sensitive value is redacted
+type RedactAction int
+
+const (
+	// RedactMask replaces the value with RedactionRule.Mask
+	RedactMask RedactAction = iota
+	// RedactHash replaces the value with "sha256:" followed by the hex
+	// encoded SHA-256 (or HMAC-SHA256, if RedactionRule.HashKey is set)
+	// of the value, so that equal values can still be correlated
+	RedactHash
+)
+
+// Patterns that may be used in RedactionRule.Patterns
+var (
+	EmailPattern      = regexp.MustCompile(`[a-zA-Z0-9._%+\-]+@[a-zA-Z0-9.\-]+\.[a-zA-Z]{2,}`)
+	CardNumberPattern = regexp.MustCompile(`\b(?:\d[ \-]?){12,18}\d\b`)
+)
+
+// RedactionRule describes the values to redact from records. Records are
+// walked recursively, including nested maps, slices and structs (using
+// the `msgpack` or `json` field tags as keys). Values that encode
+// themselves (encoding.TextMarshaler, such as time.Time, json.Marshaler
+// or msgpack.EncodeMsgpacker) are left alone, unless their key is one of
+// Keys. Values with nothing to redact are passed on unchanged.
+type RedactionRule struct {
+	// Tags is matched against the tag, and uses the same syntax as
+	// Route.Pattern. If empty, the rule applies to all tags
+	Tags string
+	// Keys lists the keys (compared case-insensitively) whose values are
+	// redacted entirely, whatever their type, e.g. "password"
+	Keys []string
+	// Patterns are searched for in every string value, and each match
+	// is redacted, e.g. EmailPattern
+	Patterns []*regexp.Regexp
+	// Detector, if set, is called with every key and value. The value is
+	// redacted entirely if it returns true
+	Detector func(key string, value interface{}) bool
+	// Action specifies how values are redacted
+	Action RedactAction
+	// Mask replaces redacted values when Action is RedactMask. The
+	// default is "[REDACTED]"
+	Mask string
+	// HashKey, if set, is used to compute an HMAC when Action is
+	// RedactHash, so that hashed values cannot be guessed
+	HashKey []byte
+}
+
+// WithRedaction specifies that the values described by rules should be
+// redacted from every record given to Post, before it is encoded. It is
+// applied along with (and in the same order as) the filters given to
+// WithFilters.
+func WithRedaction(rules ...RedactionRule) Option {
+	return &option{
+		name:  optkeyRedaction,
+		value: rules,
+	}
+}
+
+// Redact returns a Filter that redacts the values described by rules.
+// Rules whose Tags pattern is invalid never match; use WithRedaction to
+// have them reported by the client constructor.
+func Redact(rules ...RedactionRule) Filter {
+	redactors := make([]*redactor, len(rules))
+	for i, rule := range rules {
+		redactors[i] = newRedactor(rule)
+	}
+	return func(tag string, t time.Time, record interface{}) (string, time.Time, interface{}, bool) {
+		for _, r := range redactors {
+			if r.tagsValid && matchTag(r.tags, tag) {
+				record, _ = r.walk("", reflect.ValueOf(record))
+			}
+		}
+		return tag, t, record, true
+	}
+}
+
+type redactor struct {
+	rule      RedactionRule
+	tags      *regexp.Regexp
+	tagsValid bool
+	keys      map[string]struct{}
+}
+
+var (
+	textMarshalerType  = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	jsonMarshalerType  = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	msgpackEncoderType = reflect.TypeOf((*msgpack.EncodeMsgpacker)(nil)).Elem()
+)
+
+func newRedactor(rule RedactionRule) *redactor {
+	if rule.Mask == "" {
+		rule.Mask = "[REDACTED]"
+	}
+	r := &redactor{rule: rule, keys: make(map[string]struct{}, len(rule.Keys))}
+	if re, err := compileTagMatcher(rule.Tags); err == nil {
+		r.tags = re
+		r.tagsValid = true
+	}
+	for _, k := range rule.Keys {
+		r.keys[strings.ToLower(k)] = struct{}{}
+	}
+	return r
+}
+
+// walk returns a redacted copy of v, which is found under key, and
+// whether anything was redacted. Values with nothing to redact are
+// returned as is, so that their encoding does not change
+func (r *redactor) walk(key string, v reflect.Value) (interface{}, bool) {
+	if !v.IsValid() {
+		return nil, false
+	}
+	orig := v
+	// unwrap interfaces and pointers
+	for v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return orig.Interface(), false
+		}
+		if customEncoded(v.Type()) {
+			break
+		}
+		v = v.Elem()
+	}
+
+	if r.rule.Detector != nil && r.rule.Detector(key, v.Interface()) {
+		return r.redact(fmt.Sprint(v.Interface())), true
+	}
+	if customEncoded(v.Type()) {
+		return orig.Interface(), false
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		s := v.String()
+		for _, re := range r.rule.Patterns {
+			s = re.ReplaceAllStringFunc(s, r.redact)
+		}
+		if s == v.String() {
+			return orig.Interface(), false
+		}
+		return s, true
+	case reflect.Map:
+		// maps decoded from msgpack or YAML have interface{} keys: they
+		// are matched by their string form, and keep their type
+		var changed bool
+		if v.Type().Key().Kind() == reflect.String {
+			out := make(map[string]interface{}, v.Len())
+			for _, k := range v.MapKeys() {
+				var c bool
+				out[k.String()], c = r.field(k.String(), v.MapIndex(k))
+				changed = changed || c
+			}
+			if changed {
+				return out, true
+			}
+			return orig.Interface(), false
+		}
+		out := make(map[interface{}]interface{}, v.Len())
+		for _, k := range v.MapKeys() {
+			var c bool
+			out[k.Interface()], c = r.field(fmt.Sprint(k.Interface()), v.MapIndex(k))
+			changed = changed || c
+		}
+		if changed {
+			return out, true
+		}
+		return orig.Interface(), false
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			// []byte is encoded as binary, not as a list
+			return orig.Interface(), false
+		}
+		var changed bool
+		out := make([]interface{}, v.Len())
+		for i := range out {
+			var c bool
+			out[i], c = r.walk(key, v.Index(i))
+			changed = changed || c
+		}
+		if changed {
+			return out, true
+		}
+		return orig.Interface(), false
+	case reflect.Struct:
+		out := make(map[string]interface{}, v.NumField())
+		if r.walkStruct(v, out) {
+			return out, true
+		}
+		return orig.Interface(), false
+	}
+	return orig.Interface(), false
+}
+
+// walkStruct stores the redacted fields of v in out, the way they are
+// encoded: empty fields tagged "omitempty" are skipped, and the fields
+// of embedded structs are promoted, unless v has a field of the same
+// name. Returns whether anything was redacted
+func (r *redactor) walkStruct(v reflect.Value, out map[string]interface{}) bool {
+	var changed bool
+	var embedded []reflect.Value
+	typ := v.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		fv := v.Field(i)
+		name, omitempty, tagged := fieldName(f)
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && !tagged {
+			ev := fv
+			if ev.Kind() == reflect.Ptr {
+				if ev.IsNil() {
+					continue
+				}
+				ev = ev.Elem()
+			}
+			if ev.Kind() == reflect.Struct && !customEncoded(ev.Type()) {
+				embedded = append(embedded, ev)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		if omitempty && isEmptyValue(fv) {
+			continue
+		}
+		var c bool
+		out[name], c = r.field(name, fv)
+		changed = changed || c
+	}
+
+	for _, ev := range embedded {
+		promoted := make(map[string]interface{})
+		if r.walkStruct(ev, promoted) {
+			changed = true
+		}
+		for name, value := range promoted {
+			if _, ok := out[name]; !ok {
+				out[name] = value
+			}
+		}
+	}
+	return changed
+}
+
+// field redacts v entirely if key is one of the sensitive keys,
+// otherwise walks it
+func (r *redactor) field(key string, v reflect.Value) (interface{}, bool) {
+	if _, ok := r.keys[strings.ToLower(key)]; ok {
+		if !v.IsValid() || ((v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr) && v.IsNil()) {
+			return nil, false
+		}
+		return r.redact(fmt.Sprint(v.Interface())), true
+	}
+	return r.walk(key, v)
+}
+
+// redact returns the replacement for s
+func (r *redactor) redact(s string) string {
+	if r.rule.Action != RedactHash {
+		return r.rule.Mask
+	}
+	var h hash.Hash
+	if len(r.rule.HashKey) > 0 {
+		h = hmac.New(sha256.New, r.rule.HashKey)
+	} else {
+		h = sha256.New()
+	}
+	h.Write([]byte(s))
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// fieldName returns the key used for a struct field, following the
+// msgpack and json tags, whether it is tagged "omitempty", and whether
+// the name comes from a tag
+func fieldName(f reflect.StructField) (string, bool, bool) {
+	for _, key := range []string{"msgpack", "json"} {
+		if tag, ok := f.Tag.Lookup(key); ok {
+			parts := strings.Split(tag, ",")
+			var omitempty bool
+			for _, opt := range parts[1:] {
+				omitempty = omitempty || opt == "omitempty"
+			}
+			if parts[0] != "" {
+				return parts[0], omitempty, true
+			}
+			return f.Name, omitempty, false
+		}
+	}
+	return f.Name, false, false
+}
+
+// customEncoded reports whether values of typ control their own
+// encoding, in which case they are left alone
+func customEncoded(typ reflect.Type) bool {
+	for _, t := range []reflect.Type{textMarshalerType, jsonMarshalerType, msgpackEncoderType} {
+		if typ.Implements(t) || (typ.Kind() != reflect.Ptr && reflect.PtrTo(typ).Implements(t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isEmptyValue reports whether v is skipped by "omitempty"
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package fluent_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	fluent "github.com/Edwardsj/fluent-client"
+	"github.com/stretchr/testify/assert"
+)
+
+type redactUser struct {
+	Name     string `msgpack:"name"`
+	Password string `json:"password"`
+	Contact  map[string]interface{}
+	secret   string
+}
+
+func TestRedact(t *testing.T) {
+	now := time.Now()
+	filter := fluent.Redact(
+		fluent.RedactionRule{
+			Keys:     []string{"password", "Token"},
+			Patterns: []*regexp.Regexp{fluent.EmailPattern, fluent.CardNumberPattern},
+		},
+		fluent.RedactionRule{
+			Tags: "audit.**",
+			Detector: func(key string, value interface{}) bool {
+				return key == "ssn"
+			},
+			Action: fluent.RedactHash,
+		},
+	)
+
+	record := map[string]interface{}{
+		"message": "mail john@example.com, card 4111 1111 1111 1111",
+		"token":   12345,
+		"ssn":     "123-45-6789",
+		"at":      now,
+		"users": []interface{}{
+			&redactUser{
+				Name:     "john",
+				Password: "hunter2",
+				Contact:  map[string]interface{}{"email": "john@example.com"},
+				secret:   "unexported",
+			},
+		},
+	}
+
+	_, _, v, ok := filter("app", now, record)
+	if !assert.True(t, ok, `redaction should not drop records`) {
+		return
+	}
+	expected := map[string]interface{}{
+		"message": "mail [REDACTED], card [REDACTED]",
+		"token":   "[REDACTED]",
+		"ssn":     "123-45-6789",
+		"at":      now,
+		"users": []interface{}{
+			map[string]interface{}{
+				"name":     "john",
+				"password": "[REDACTED]",
+				"Contact":  map[string]interface{}{"email": "[REDACTED]"},
+			},
+		},
+	}
+	if !assert.Equal(t, expected, v, `record should be redacted`) {
+		return
+	}
+	if !assert.Equal(t, "123-45-6789", record["ssn"], `original record should not be modified`) {
+		return
+	}
+
+	sum := sha256.Sum256([]byte("123-45-6789"))
+	for _, tag := range []string{"audit", "audit.login", "audit.login.failed"} {
+		_, _, v, _ = filter(tag, now, map[string]interface{}{"ssn": "123-45-6789"})
+		if !assert.Equal(t, map[string]interface{}{"ssn": "sha256:" + hex.EncodeToString(sum[:])}, v, `ssn should be hashed for audit tags`) {
+			return
+		}
+	}
+
+	_, err := fluent.New(fluent.WithRedaction(fluent.RedactionRule{Tags: "audit.{login", Keys: []string{"password"}}))
+	if !assert.Error(t, err, `invalid tag pattern should be rejected`) {
+		return
+	}
+	if !assert.True(t, strings.Contains(err.Error(), "invalid tag pattern"), `error should mention the tag pattern`) {
+		return
+	}
+}
+
+type redactBase struct {
+	Password string `json:"password"`
+	Note     string `json:"note,omitempty"`
+}
+
+type redactAccount struct {
+	redactBase
+	Name string `json:"name"`
+}
+
+type redactProfile struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags,omitempty"`
+}
+
+type redactOpaque struct {
+	Email string
+}
+
+func (o redactOpaque) MarshalJSON() ([]byte, error) {
+	return []byte(`"opaque"`), nil
+}
+
+func TestRedactShapes(t *testing.T) {
+	now := time.Now()
+	filter := fluent.Redact(fluent.RedactionRule{
+		Keys:     []string{"password"},
+		Patterns: []*regexp.Regexp{fluent.EmailPattern},
+	})
+
+	t.Run("non-string keys", func(t *testing.T) {
+		record := map[interface{}]interface{}{"password": "hunter2", 1: "one"}
+		_, _, v, _ := filter("app", now, record)
+		if !assert.Equal(t, map[interface{}]interface{}{"password": "[REDACTED]", 1: "one"}, v, `maps with non-string keys should be redacted`) {
+			return
+		}
+	})
+
+	t.Run("nothing to redact", func(t *testing.T) {
+		record := &redactProfile{Name: "john"}
+		_, _, v, _ := filter("app", now, map[string]interface{}{"profile": record, "message": "hello"})
+		if !assert.True(t, v.(map[string]interface{})["profile"] == record, `values with nothing to redact should be left as is`) {
+			return
+		}
+	})
+
+	t.Run("embedded and omitempty", func(t *testing.T) {
+		record := redactAccount{redactBase: redactBase{Password: "hunter2"}, Name: "john"}
+		_, _, v, _ := filter("app", now, record)
+		if !assert.Equal(t, map[string]interface{}{"password": "[REDACTED]", "name": "john"}, v, `struct should be redacted in its encoded shape`) {
+			return
+		}
+	})
+
+	t.Run("custom encoding", func(t *testing.T) {
+		record := map[string]interface{}{"contact": redactOpaque{Email: "john@example.com"}}
+		_, _, v, _ := filter("app", now, record)
+		if !assert.Equal(t, record, v, `values that encode themselves should be left as is`) {
+			return
+		}
+	})
+}
@@ -0,0 +1,239 @@
+package fluent
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Route sends the records whose tag matches Pattern to Client
+type Route struct {
+	// Pattern uses the syntax of fluentd's <match> directive: "*" matches
+	// a single tag part, "**" matches zero or more tag parts, and "{a,b}"
+	// matches either a or b. Several patterns may be separated by spaces
+	Pattern string
+	Client  Client
+	// Copy specifies that matching records are sent to Client, and also
+	// to the routes that follow (or the default client), instead of
+	// stopping at this route
+	Copy bool
+}
+
+// Router is a Client that dispatches records to other Clients according
+// to their tag. Routes are evaluated in order: a record goes to every
+// matching copy route, and to the first matching route that is not a
+// copy route. Records that do not reach a route other than a copy route
+// go to the default client.
+type Router struct {
+	def     Client
+	routes  []route
+	clients []Client
+}
+
+type route struct {
+	re     *regexp.Regexp
+	client Client
+	copy   bool
+}
+
+// NewRouter creates a new Router. defaultClient receives the records
+// that do not match any route, and may be nil if such records should be
+// rejected.
+func NewRouter(defaultClient Client, routes ...Route) (*Router, error) {
+	r := &Router{def: defaultClient}
+	seen := make(map[Client]struct{})
+	addClient := func(c Client) {
+		if _, ok := seen[c]; !ok {
+			seen[c] = struct{}{}
+			r.clients = append(r.clients, c)
+		}
+	}
+
+	for i, rt := range routes {
+		if rt.Client == nil {
+			return nil, errors.Errorf(`route #%d (%q) has no client`, i+1, rt.Pattern)
+		}
+		re, err := compileTagPattern(rt.Pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, `route #%d`, i+1)
+		}
+		r.routes = append(r.routes, route{re: re, client: rt.Client, copy: rt.Copy})
+		addClient(rt.Client)
+	}
+	if defaultClient != nil {
+		addClient(defaultClient)
+	}
+	return r, nil
+}
+
+// compileTagPattern converts a fluentd style match pattern into a
+// regular expression
+func compileTagPattern(pattern string) (*regexp.Regexp, error) {
+	fields := strings.Fields(pattern)
+	if len(fields) == 0 {
+		return nil, errors.New(`empty tag pattern`)
+	}
+
+	alternatives := make([]string, len(fields))
+	for i, f := range fields {
+		expr, err := tagPatternExpr(f)
+		if err != nil {
+			return nil, errors.Wrapf(err, `invalid tag pattern %q`, pattern)
+		}
+		alternatives[i] = expr
+	}
+	return regexp.Compile(`^(?:` + strings.Join(alternatives, `|`) + `)$`)
+}
+
+// compileTagMatcher is like compileTagPattern, except that an empty
+// pattern gives a nil *regexp.Regexp, which matches every tag
+func compileTagMatcher(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return compileTagPattern(pattern)
+}
+
+// matchTag reports whether tag matches re, as returned by compileTagMatcher
+func matchTag(re *regexp.Regexp, tag string) bool {
+	return re == nil || re.MatchString(tag)
+}
+
+func tagPatternExpr(pattern string) (string, error) {
+	var buf strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case strings.HasPrefix(pattern[i:], "**"):
+			switch {
+			case strings.HasSuffix(buf.String(), `\.`):
+				// "a.**" also matches "a"
+				s := strings.TrimSuffix(buf.String(), `\.`)
+				buf.Reset()
+				buf.WriteString(s)
+				buf.WriteString(`(?:\.[^.]+)*`)
+			case strings.HasPrefix(pattern[i+2:], "."):
+				// "**.a" also matches "a"
+				buf.WriteString(`(?:[^.]+\.)*`)
+				i++
+			default:
+				buf.WriteString(`.*`)
+			}
+			i++
+		case c == '*':
+			buf.WriteString(`[^.]*`)
+		case c == '{':
+			end := strings.IndexByte(pattern[i:], '}')
+			if end < 0 {
+				return "", errors.New(`unterminated "{"`)
+			}
+			var alternatives []string
+			for _, alt := range strings.Split(pattern[i+1:i+end], ",") {
+				expr, err := tagPatternExpr(alt)
+				if err != nil {
+					return "", err
+				}
+				alternatives = append(alternatives, expr)
+			}
+			buf.WriteString(`(?:` + strings.Join(alternatives, `|`) + `)`)
+			i += end
+		case c == '}':
+			return "", errors.New(`unexpected "}"`)
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return buf.String(), nil
+}
+
+// targets returns the clients that should receive records for tag. The
+// result is not cached, as tags may be unbounded (e.g. contain IDs)
+func (r *Router) targets(tag string) []Client {
+	var clients []Client
+	var routed bool
+	for _, rt := range r.routes {
+		if !rt.re.MatchString(tag) {
+			continue
+		}
+		clients = append(clients, rt.client)
+		if !rt.copy {
+			routed = true
+			break
+		}
+	}
+	if !routed && r.def != nil {
+		clients = append(clients, r.def)
+	}
+	return clients
+}
+
+// Post posts the record to the clients that tag is routed to. If more
+// than one of them fails, a MultiError is returned
+func (r *Router) Post(tag string, v interface{}, options ...Option) error {
+	return r.dispatch(tag, func(c Client) error {
+		return c.Post(tag, v, options...)
+	})
+}
+
+// Ping pings the clients that tag is routed to
+func (r *Router) Ping(tag string, v interface{}, options ...Option) error {
+	return r.dispatch(tag, func(c Client) error {
+		return c.Ping(tag, v, options...)
+	})
+}
+
+func (r *Router) dispatch(tag string, f func(Client) error) error {
+	clients := r.targets(tag)
+	if len(clients) == 0 {
+		return errors.Errorf(`no route for tag %q`, tag)
+	}
+
+	var errs MultiError
+	for _, c := range clients {
+		if err := f(c); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs.errorOrNil()
+}
+
+// Close closes all of the clients
+func (r *Router) Close() error {
+	var errs MultiError
+	for _, c := range r.clients {
+		if err := c.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs.errorOrNil()
+}
+
+// Shutdown shuts all of the clients down concurrently, and waits for
+// them (or for ctx to be canceled)
+func (r *Router) Shutdown(ctx context.Context) error {
+	return shutdownAll(ctx, r.clients)
+}
+
+// shutdownAll shuts clients down concurrently
+func shutdownAll(ctx context.Context, clients []Client) error {
+	errs := make([]error, len(clients))
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, c Client) {
+			defer wg.Done()
+			errs[i] = c.Shutdown(ctx)
+		}(i, c)
+	}
+	wg.Wait()
+
+	var merr MultiError
+	for _, err := range errs {
+		if err != nil {
+			merr = append(merr, err)
+		}
+	}
+	return merr.errorOrNil()
+}
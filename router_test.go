@@ -0,0 +1,99 @@
+package fluent_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	fluent "github.com/Edwardsj/fluent-client"
+	"github.com/stretchr/testify/assert"
+)
+
+// tagClient is a Client that remembers the tags posted to it
+type tagClient struct {
+	mu       sync.Mutex
+	tags     []string
+	shutdown bool
+}
+
+func (c *tagClient) Post(tag string, _ interface{}, _ ...fluent.Option) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tags = append(c.tags, tag)
+	return nil
+}
+
+func (c *tagClient) Ping(tag string, v interface{}, options ...fluent.Option) error {
+	return c.Post(tag, v, options...)
+}
+
+func (c *tagClient) Close() error {
+	return nil
+}
+
+func (c *tagClient) Shutdown(_ context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.shutdown = true
+	return nil
+}
+
+func (c *tagClient) Tags() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tags
+}
+
+func TestRouter(t *testing.T) {
+	var audit, app, archive, def tagClient
+	router, err := fluent.NewRouter(&def,
+		fluent.Route{Pattern: "**", Client: &archive, Copy: true},
+		fluent.Route{Pattern: "*.audit audit.**", Client: &audit},
+		fluent.Route{Pattern: "app.{web,api}.**", Client: &app},
+	)
+	if !assert.NoError(t, err, `NewRouter should succeed`) {
+		return
+	}
+
+	tags := []string{"app.audit", "audit", "audit.login.failed", "app.web", "app.api.v1", "app.worker", "app.web.audit.x"}
+	for _, tag := range tags {
+		if !assert.NoError(t, router.Post(tag, map[string]interface{}{"tag": tag}), `Post should succeed`) {
+			return
+		}
+	}
+
+	if !assert.Equal(t, tags, archive.Tags(), `copy route should receive everything`) {
+		return
+	}
+	if !assert.Equal(t, []string{"app.audit", "audit", "audit.login.failed"}, audit.Tags(), `audit route should match`) {
+		return
+	}
+	if !assert.Equal(t, []string{"app.web", "app.api.v1", "app.web.audit.x"}, app.Tags(), `app route should match`) {
+		return
+	}
+	if !assert.Equal(t, []string{"app.worker"}, def.Tags(), `default route should receive the rest`) {
+		return
+	}
+
+	if !assert.NoError(t, router.Shutdown(context.Background()), `Shutdown should succeed`) {
+		return
+	}
+	for _, c := range []*tagClient{&audit, &app, &archive, &def} {
+		if !assert.True(t, c.shutdown, `every client should be shut down`) {
+			return
+		}
+	}
+
+	noDefault, err := fluent.NewRouter(nil, fluent.Route{Pattern: "app.*", Client: &app})
+	if !assert.NoError(t, err, `NewRouter should succeed`) {
+		return
+	}
+	if !assert.Error(t, noDefault.Post("other", nil), `Post without a route should fail`) {
+		return
+	}
+
+	_, err = fluent.NewRouter(nil, fluent.Route{Pattern: "app.{web", Client: &app})
+	if !assert.Error(t, err, `invalid pattern should be rejected`) {
+		return
+	}
+}
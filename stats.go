@@ -0,0 +1,115 @@
+package fluent
+
+import (
+	"sort"
+	"time"
+)
+
+// Stats describes the contents of the buffer of a Buffered client
+type Stats struct {
+	// BufferLimit is the maximum number of bytes that can be buffered
+	BufferLimit int
+	// BufferedBytes is the number of bytes waiting to be written
+	BufferedBytes int
+	// Records is the number of records waiting to be written
+	Records int
+	// QueuedChunks is the number of chunks that have been closed, and
+	// are waiting to be (or being) written
+	QueuedChunks int
+	// DroppedRecords is the number of records discarded to make room
+	// for new ones (see OverflowDropOldest)
+	DroppedRecords int
+	// ExpiredRecords is the number of records discarded because they
+	// were older than their max age (see WithMaxRecordAge)
+	ExpiredRecords int
+	// Queues describes each buffer set up with WithTagBuffer, followed
+	// by the buffer for all other tags
+	Queues []QueueStats
+	// Chunks describes every chunk in the buffer, oldest first
+	Chunks []ChunkStats
+}
+
+// ChunkStats describes a single buffer chunk
+type ChunkStats struct {
+	ID      uint64
+	Tag     string
+	Records int
+	Size    int
+	Created time.Time
+	Retries int
+	// Queued is false while records are still being appended to the chunk
+	Queued bool
+}
+
+// QueueStats describes the records buffered for a TagBuffer
+type QueueStats struct {
+	// Pattern is the tag pattern of the TagBuffer, or "" for the buffer
+	// of the records that do not match any TagBuffer
+	Pattern        string
+	Priority       int
+	Limit          int
+	BufferedBytes  int
+	Records        int
+	DroppedRecords int
+	ExpiredRecords int
+}
+
+// Stats returns a snapshot of the contents of the buffer
+func (c *Buffered) Stats() Stats {
+	return c.minionStats()
+}
+
+// FailingSince returns the time since when the client has been unable to
+// connect to the server, or to write to it. The zero time is returned
+// while records are being delivered (or before the first attempt).
+func (c *Buffered) FailingSince() time.Time {
+	return c.minionFailing()
+}
+
+// bufferUsage is the part of Stats that is cheap to compute, for
+// checking how full the buffer is on every record
+type bufferUsage struct {
+	limit   int
+	bytes   int
+	records int
+}
+
+// bufferUsage returns how full the buffer is, without taking a
+// snapshot of every chunk like Stats
+func (c *Buffered) bufferUsage() bufferUsage {
+	return c.minionUsage()
+}
+
+func (m *minion) usage() bufferUsage {
+	u := bufferUsage{limit: m.bufferLimit}
+	if m.method == "http" {
+		u.records = len(m.httpCh)
+		return u
+	}
+	for _, l := range m.lanes {
+		l.usage(&u)
+	}
+	return u
+}
+
+func (m *minion) stats() Stats {
+	s := Stats{BufferLimit: m.bufferLimit}
+	if m.method == "http" {
+		s.Records = len(m.httpCh)
+		return s
+	}
+
+	for _, b := range m.tagBuffers {
+		s.Queues = append(s.Queues, QueueStats{
+			Pattern:  b.Pattern,
+			Priority: b.Priority,
+			Limit:    b.Limit,
+		})
+	}
+	s.Queues = append(s.Queues, QueueStats{})
+	for _, l := range m.lanes {
+		l.stats(&s)
+	}
+	sort.Slice(s.Chunks, func(i, j int) bool { return s.Chunks[i].ID < s.Chunks[j].ID })
+	return s
+}
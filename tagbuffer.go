@@ -0,0 +1,100 @@
+package fluent
+
+import (
+	"time"
+)
+
+// OverflowPolicy specifies what happens to a record that does not fit
+// in its buffer
+type OverflowPolicy int
+
+const (
+	// OverflowReject rejects the new record. This is the default, and
+	// is reported as a buffer full error when WithSyncAppend is used
+	OverflowReject OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest chunks of the same buffer
+	// (other than the one being written) to make room for the new record
+	OverflowDropOldest
+)
+
+// TagBuffer describes a separate buffer for the records whose tag
+// matches Pattern
+type TagBuffer struct {
+	// Pattern is matched against the tag (including the tag prefix), and
+	// uses the same syntax as Route.Pattern, e.g. "debug.**" or "audit"
+	Pattern string
+	// Limit is the maximum number of bytes buffered for matching tags.
+	// The buffer limit still applies to all records combined. 0 means
+	// that only the buffer limit applies. Like the buffer limit, it is
+	// divided evenly between the writers (see WithWriterConcurrency), so
+	// with WithShardByTag a single tag may only use its writer's share
+	Limit int
+	// Priority specifies the order in which buffers are written:
+	// chunks from buffers with a higher priority are written first.
+	// Records whose tag does not match any TagBuffer have priority 0
+	Priority int
+	// Overflow specifies what to do with a record that does not fit
+	Overflow OverflowPolicy
+	// MaxAge overrides WithMaxRecordAge for matching tags
+	MaxAge time.Duration
+}
+
+// WithMaxRecordAge specifies that buffered records older than d should
+// be discarded instead of being written, e.g. after a long outage. Records
+// are buffered in chunks, and a chunk expires along with its oldest
+// record. Expired records are reported by Stats. Use TagBuffer.MaxAge to
+// set a different age for some tags. By default records never expire
+func WithMaxRecordAge(d time.Duration) Option {
+	return &option{
+		name:  optkeyMaxRecordAge,
+		value: d,
+	}
+}
+
+// WithTagBuffer sets up a separate buffer, with its own limit, priority
+// and overflow policy, for the records whose tag matches b.Pattern. This
+// can be used to make sure that a noisy tag does not cause important
+// records to be dropped. May be specified multiple times; the first
+// matching TagBuffer is used.
+func WithTagBuffer(b TagBuffer) Option {
+	return &option{
+		name:  optkeyTagBuffer,
+		value: b,
+	}
+}
+
+// bufferClass returns the index of the TagBuffer for tag. Records that
+// do not match any TagBuffer belong to the last class. Only called from
+// the reader goroutine
+func (m *minion) bufferClass(tag string) int {
+	for i, re := range m.tagPatterns {
+		if re.MatchString(tag) {
+			return i
+		}
+	}
+	return len(m.tagBuffers)
+}
+
+// laneClasses creates the per-lane state for each buffer class, with
+// the limits divided evenly between n lanes
+func laneClasses(tagBuffers []TagBuffer, maxAge time.Duration, n int) []laneClass {
+	classes := make([]laneClass, len(tagBuffers)+1)
+	classes[len(tagBuffers)].maxAge = maxAge
+	for i, b := range tagBuffers {
+		classes[i] = laneClass{
+			priority: b.Priority,
+			overflow: b.Overflow,
+			maxAge:   maxAge,
+		}
+		if b.MaxAge > 0 {
+			classes[i].maxAge = b.MaxAge
+		}
+		if b.Limit > 0 {
+			classes[i].limit = b.Limit / n
+			if classes[i].limit < 1 {
+				classes[i].limit = 1
+			}
+		}
+	}
+	return classes
+}
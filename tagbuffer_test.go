@@ -0,0 +1,178 @@
+package fluent_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	fluent "github.com/Edwardsj/fluent-client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTagBuffer(t *testing.T) {
+	record := map[string]interface{}{"message": "0123456789"}
+
+	t.Run("limits and overflow", func(t *testing.T) {
+		// nothing listens on this address, and the write threshold is never
+		// reached, so everything stays in the buffer
+		client, err := fluent.NewBuffered(
+			fluent.WithAddress("127.0.0.1:1"),
+			fluent.WithWriteThreshold(1024*1024),
+			fluent.WithChunkSizeLimit(100),
+			fluent.WithTagBuffer(fluent.TagBuffer{Pattern: "debug.*", Limit: 200, Overflow: fluent.OverflowDropOldest}),
+			fluent.WithTagBuffer(fluent.TagBuffer{Pattern: "audit", Limit: 100}),
+		)
+		if !assert.NoError(t, err, `NewBuffered should succeed`) {
+			return
+		}
+		defer client.Close()
+
+		for i := 0; i < 20; i++ {
+			if !assert.NoError(t, client.Post("debug.noisy", record, fluent.WithSyncAppend(true)), `Post to a drop-oldest buffer should succeed`) {
+				return
+			}
+		}
+
+		var rejected bool
+		for i := 0; i < 10; i++ {
+			if err := client.Post("audit", record, fluent.WithSyncAppend(true)); err != nil {
+				if !assert.True(t, fluent.IsBufferFull(err), `Post should fail with a buffer full error`) {
+					return
+				}
+				rejected = true
+				break
+			}
+		}
+		if !assert.True(t, rejected, `records beyond the audit limit should be rejected`) {
+			return
+		}
+
+		if !assert.NoError(t, client.Post("other", record, fluent.WithSyncAppend(true)), `Post to the default buffer should succeed`) {
+			return
+		}
+
+		stats := client.Stats()
+		if !assert.Len(t, stats.Queues, 3, `there should be 3 queues`) {
+			return
+		}
+		debug := stats.Queues[0]
+		if !assert.Equal(t, "debug.*", debug.Pattern, `first queue should be for debug.*`) {
+			return
+		}
+		if !assert.True(t, debug.BufferedBytes <= 200, `debug queue should stay within its limit`) {
+			return
+		}
+		if !assert.True(t, debug.DroppedRecords > 0, `debug queue should have dropped records`) {
+			return
+		}
+		if !assert.Equal(t, 20, debug.Records+debug.DroppedRecords, `every debug record should be buffered or dropped`) {
+			return
+		}
+		if !assert.Equal(t, 1, stats.Queues[2].Records, `default queue should hold one record`) {
+			return
+		}
+	})
+
+	t.Run("sharded", func(t *testing.T) {
+		client, err := fluent.NewBuffered(
+			fluent.WithAddress("127.0.0.1:1"),
+			fluent.WithWriteThreshold(1024*1024),
+			fluent.WithChunkSizeLimit(100),
+			fluent.WithWriterConcurrency(2),
+			fluent.WithShardByTag(true),
+			fluent.WithTagBuffer(fluent.TagBuffer{Pattern: "audit", Limit: 200}),
+		)
+		if !assert.NoError(t, err, `NewBuffered should succeed`) {
+			return
+		}
+		defer client.Close()
+
+		var rejected bool
+		for i := 0; i < 20; i++ {
+			if err := client.Post("audit", record, fluent.WithSyncAppend(true)); err != nil {
+				if !assert.True(t, fluent.IsBufferFull(err), `Post should fail with a buffer full error`) {
+					return
+				}
+				rejected = true
+				break
+			}
+		}
+		if !assert.True(t, rejected, `records beyond the limit should be rejected`) {
+			return
+		}
+		// every audit record goes to the same writer, which only has
+		// half of the limit
+		audit := client.Stats().Queues[0]
+		if !assert.Equal(t, 200, audit.Limit, `the queue should report the configured limit`) {
+			return
+		}
+		if !assert.True(t, audit.BufferedBytes > 0 && audit.BufferedBytes <= 100, `a sharded tag should only use its writer's share of the limit`) {
+			return
+		}
+	})
+
+	t.Run("patterns", func(t *testing.T) {
+		client, err := fluent.NewBuffered(
+			fluent.WithAddress("127.0.0.1:1"),
+			fluent.WithWriteThreshold(1024*1024),
+			fluent.WithTagBuffer(fluent.TagBuffer{Pattern: "{audit,security}.**"}),
+		)
+		if !assert.NoError(t, err, `NewBuffered should succeed`) {
+			return
+		}
+		defer client.Close()
+
+		for _, tag := range []string{"audit", "security.login.failed", "app.audit"} {
+			if !assert.NoError(t, client.Post(tag, record, fluent.WithSyncAppend(true)), `Post should succeed`) {
+				return
+			}
+		}
+		stats := client.Stats()
+		if !assert.Equal(t, 2, stats.Queues[0].Records, `tags should be matched like fluentd's <match>`) {
+			return
+		}
+		if !assert.Equal(t, 1, stats.Queues[1].Records, `other tags should go to the default queue`) {
+			return
+		}
+
+		_, err = fluent.NewBuffered(fluent.WithTagBuffer(fluent.TagBuffer{Pattern: "audit.{"}))
+		if !assert.IsType(t, &fluent.OptionError{}, err, `an invalid pattern should be rejected`) {
+			return
+		}
+	})
+
+	t.Run("priority", func(t *testing.T) {
+		s := newMultiConnServer(t)
+		client, err := fluent.New(
+			fluent.WithAddress(s.listener.Addr().String()),
+			fluent.WithWriteThreshold(1024*1024),
+			fluent.WithTagBuffer(fluent.TagBuffer{Pattern: "audit", Priority: 10}),
+		)
+		if !assert.NoError(t, err, `fluent.New should succeed`) {
+			return
+		}
+
+		for i := 0; i < 10; i++ {
+			if !assert.NoError(t, client.Post("debug", record, fluent.WithSyncAppend(true)), `Post should succeed`) {
+				return
+			}
+		}
+		if !assert.NoError(t, client.Post("audit", record, fluent.WithSyncAppend(true)), `Post should succeed`) {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if !assert.NoError(t, client.Shutdown(ctx), `Shutdown should succeed`) {
+			return
+		}
+
+		records := s.Records(11)
+		if !assert.Len(t, records, 11, `server should receive every record`) {
+			return
+		}
+		if !assert.Equal(t, "audit", records[0].tag, `higher priority records should be written first`) {
+			return
+		}
+	})
+}
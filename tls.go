@@ -1,16 +1,352 @@
 package fluent
 
-import "crypto/tls"
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
 
+	pdebug "github.com/lestrrat-go/pdebug"
+	"github.com/pkg/errors"
+)
+
+// TLSConfig describes how connections to the server are secured.
+// It is assembled by the client constructors from WithTLS, WithTLSFiles,
+// WithTLSServerName and WithTLSMinVersion.
 type TLSConfig struct {
-	Enable bool
-	Conf   tls.Config
+	Enable     bool
+	Conf       tls.Config
+	ServerName string
+	MinVersion uint16
+	files      *tlsFiles
 }
 
-// is tls means if the connection is with tls
+// WithTLS enables TLS, using the given configuration as the base for
+// each new connection
 func WithTLS(conf tls.Config) Option {
 	return &option{
 		name:  optkeyWithTLS,
 		value: conf,
 	}
 }
+
+type tlsFileNames struct {
+	certFile string
+	keyFile  string
+	caFile   string
+}
+
+// WithTLSFiles enables TLS, using the PEM encoded client certificate and
+// key from certFile and keyFile (for mutual TLS), and the CA certificates
+// in caFile to verify the server. Either the certificate/key pair or the
+// CA file may be left empty.
+//
+// The files are polled for changes (see WithTLSReloadInterval), and
+// rotated certificates are picked up by new connections without having
+// to restart the client.
+func WithTLSFiles(certFile, keyFile, caFile string) Option {
+	return &option{
+		name: optkeyTLSFiles,
+		value: tlsFileNames{
+			certFile: certFile,
+			keyFile:  keyFile,
+			caFile:   caFile,
+		},
+	}
+}
+
+// WithTLSServerName specifies the server name used to verify the
+// server's certificate. By default the host part of the address is used
+func WithTLSServerName(name string) Option {
+	return &option{
+		name:  optkeyTLSServerName,
+		value: name,
+	}
+}
+
+// WithTLSMinVersion specifies the minimum TLS version to accept,
+// e.g. tls.VersionTLS12
+func WithTLSMinVersion(v uint16) Option {
+	return &option{
+		name:  optkeyTLSMinVersion,
+		value: v,
+	}
+}
+
+// WithTLSReloadInterval specifies how often the files given to
+// WithTLSFiles are checked for changes, as measured by the client's
+// Clock. The check is performed lazily when a new connection is made.
+// The default value is 30 seconds
+func WithTLSReloadInterval(d time.Duration) Option {
+	return &option{
+		name:  optkeyTLSReloadInterval,
+		value: d,
+	}
+}
+
+func isTLSOption(name string) bool {
+	switch name {
+	case optkeyWithTLS, optkeyTLSFiles, optkeyTLSServerName, optkeyTLSMinVersion, optkeyTLSReloadInterval:
+		return true
+	}
+	return false
+}
+
+// newTLSConfig assembles a TLSConfig from the TLS related options.
+// Problems are recorded in check. Returns nil if TLS was not requested
+func newTLSConfig(check *optionChecker, options []Option, clock Clock) *TLSConfig {
+	if len(options) == 0 {
+		return nil
+	}
+
+	c := &TLSConfig{Enable: true}
+	var files *tlsFileNames
+	var filesOpt Option
+	var interval = 30 * time.Second
+	for _, opt := range options {
+		switch opt.Name() {
+		case optkeyWithTLS:
+			// the value is a tls.Config, not a pointer, so that it can
+			// not be changed after the option is created
+			switch v := opt.Value().(type) {
+			case tls.Config:
+				c.Conf = *v.Clone()
+			default:
+				check.invalid(opt, `expected tls.Config, got %T`, opt.Value())
+			}
+		case optkeyTLSFiles:
+			if v, ok := opt.Value().(tlsFileNames); ok {
+				files = &v
+				filesOpt = opt
+			} else {
+				check.invalid(opt, `expected TLS file names, got %T`, opt.Value())
+			}
+		case optkeyTLSServerName:
+			if v, ok := check.stringValue(opt); ok {
+				c.ServerName = v
+			}
+		case optkeyTLSMinVersion:
+			v, ok := opt.Value().(uint16)
+			if !ok {
+				check.invalid(opt, `expected uint16, got %T`, opt.Value())
+				continue
+			}
+			switch v {
+			case tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13:
+				c.MinVersion = v
+			default:
+				check.invalid(opt, `unknown TLS version 0x%04x`, v)
+			}
+		case optkeyTLSReloadInterval:
+			if v, ok := check.durationValue(opt); ok {
+				interval = v
+			}
+		}
+	}
+
+	if files != nil {
+		c.files = &tlsFiles{tlsFileNames: *files, interval: interval, clock: clock}
+		if err := c.files.load(); err != nil {
+			check.invalid(filesOpt, `%s`, err)
+		}
+	}
+
+	return c
+}
+
+// clientConfig creates the tls.Config to be used for a new connection
+// to the server named serverName. Certificates given via WithTLSFiles
+// are refreshed here.
+func (c *TLSConfig) clientConfig(serverName string) *tls.Config {
+	conf := c.Conf.Clone()
+
+	if c.ServerName != "" {
+		conf.ServerName = c.ServerName
+	}
+	if conf.ServerName == "" {
+		conf.ServerName = serverName
+	}
+	if c.MinVersion != 0 {
+		conf.MinVersion = c.MinVersion
+	}
+
+	if f := c.files; f != nil {
+		f.refresh()
+		if f.certFile != "" {
+			conf.Certificates = nil
+			conf.GetClientCertificate = f.getClientCertificate
+		}
+		if f.caFile != "" {
+			conf.RootCAs = f.rootCAs()
+		}
+	}
+	return conf
+}
+
+// dialTLS performs the TLS handshake over a freshly dialed connection,
+// giving up when ctx is done
+func dialTLS(ctx context.Context, dialFunc DialFunc, network, address, serverName string, tlsConfig *TLSConfig) (net.Conn, error) {
+	rawConn, err := dialFunc(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := tls.Client(rawConn, tlsConfig.clientConfig(serverName))
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- conn.Handshake()
+	}()
+
+	select {
+	case <-ctx.Done():
+		rawConn.Close()
+		<-errCh
+		return nil, errors.Wrap(ctx.Err(), `TLS handshake canceled`)
+	case err := <-errCh:
+		if err != nil {
+			rawConn.Close()
+			return nil, errors.Wrap(err, `TLS handshake failed`)
+		}
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) (fileStamp, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: fi.ModTime(), size: fi.Size()}, nil
+}
+
+// tlsFiles holds the certificates loaded from WithTLSFiles, and
+// reloads them when the underlying files change
+type tlsFiles struct {
+	tlsFileNames
+	interval time.Duration
+	clock    Clock
+
+	mu        sync.RWMutex
+	checked   time.Time
+	certStamp fileStamp
+	keyStamp  fileStamp
+	caStamp   fileStamp
+	cert      *tls.Certificate
+	roots     *x509.CertPool
+}
+
+func (f *tlsFiles) load() error {
+	if (f.certFile == "") != (f.keyFile == "") {
+		return errors.New(`certificate and key files must be specified together`)
+	}
+	if f.certFile == "" && f.caFile == "" {
+		return errors.New(`no TLS files specified`)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.reload(true)
+}
+
+// reload loads the files whose stamps have changed. Must be called
+// with f.mu held
+func (f *tlsFiles) reload(force bool) error {
+	f.checked = f.clock.Now()
+
+	if f.certFile != "" {
+		certStamp, err := statFile(f.certFile)
+		if err != nil {
+			return errors.Wrap(err, `failed to stat TLS certificate file`)
+		}
+		keyStamp, err := statFile(f.keyFile)
+		if err != nil {
+			return errors.Wrap(err, `failed to stat TLS key file`)
+		}
+		if force || certStamp != f.certStamp || keyStamp != f.keyStamp {
+			cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+			if err != nil {
+				return errors.Wrap(err, `failed to load TLS certificate/key pair`)
+			}
+			f.cert = &cert
+			f.certStamp = certStamp
+			f.keyStamp = keyStamp
+			if pdebug.Enabled {
+				pdebug.Printf("tls: loaded client certificate from %s", f.certFile)
+			}
+		}
+	}
+
+	if f.caFile != "" {
+		caStamp, err := statFile(f.caFile)
+		if err != nil {
+			return errors.Wrap(err, `failed to stat TLS CA file`)
+		}
+		if force || caStamp != f.caStamp {
+			pem, err := ioutil.ReadFile(f.caFile)
+			if err != nil {
+				return errors.Wrap(err, `failed to read TLS CA file`)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return errors.Errorf(`no certificates found in TLS CA file %s`, f.caFile)
+			}
+			f.roots = pool
+			f.caStamp = caStamp
+			if pdebug.Enabled {
+				pdebug.Printf("tls: loaded CA certificates from %s", f.caFile)
+			}
+		}
+	}
+	return nil
+}
+
+// refresh reloads the files if the reload interval has passed. Errors
+// are not fatal: we keep using the previously loaded certificates, as
+// the files may be in the middle of being rotated
+func (f *tlsFiles) refresh() {
+	f.mu.RLock()
+	due := f.clock.Now().Sub(f.checked) >= f.interval
+	f.mu.RUnlock()
+	if !due {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.clock.Now().Sub(f.checked) < f.interval {
+		return
+	}
+	if err := f.reload(false); err != nil {
+		if pdebug.Enabled {
+			pdebug.Printf("tls: failed to reload certificates, keeping previous ones: %s", err)
+		}
+	}
+}
+
+func (f *tlsFiles) getClientCertificate(_ *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	f.refresh()
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.cert, nil
+}
+
+func (f *tlsFiles) rootCAs() *x509.CertPool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.roots
+}
@@ -0,0 +1,208 @@
+package fluent_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	fluent "github.com/Edwardsj/fluent-client"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert creates a certificate for 127.0.0.1, or for the given host
+// names if any
+func newTestCert(t *testing.T, serial int64, parent *testCert, isCA bool, hosts ...string) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !assert.NoError(t, err, `GenerateKey should succeed`) {
+		t.FailNow()
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "fluent-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:         isCA,
+
+		BasicConstraintsValid: true,
+	}
+	if len(hosts) > 0 {
+		tmpl.IPAddresses = nil
+		tmpl.DNSNames = hosts
+	}
+
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if !assert.NoError(t, err, `CreateCertificate should succeed`) {
+		t.FailNow()
+	}
+	cert, err := x509.ParseCertificate(der)
+	if !assert.NoError(t, err, `ParseCertificate should succeed`) {
+		t.FailNow()
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) writeFiles(t *testing.T, certFile, keyFile string) {
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if !assert.NoError(t, err, `MarshalECPrivateKey should succeed`) {
+		t.FailNow()
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if !assert.NoError(t, ioutil.WriteFile(certFile, certPEM, 0600), `WriteFile should succeed`) {
+		t.FailNow()
+	}
+	if keyFile != "" {
+		if !assert.NoError(t, ioutil.WriteFile(keyFile, keyPEM, 0600), `WriteFile should succeed`) {
+			t.FailNow()
+		}
+	}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestTLSFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fluent-tls-")
+	if !assert.NoError(t, err, `TempDir should succeed`) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, 1, nil, true)
+	serverCert := newTestCert(t, 2, ca, false)
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	ca.writeFiles(t, caFile, "")
+	newTestCert(t, 100, ca, false).writeFiles(t, certFile, keyFile)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert.tlsCertificate()},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if !assert.NoError(t, err, `tls.Listen should succeed`) {
+		return
+	}
+	defer l.Close()
+
+	// report the serial number of each client certificate we see
+	serials := make(chan int64, 8)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			tlsConn := conn.(*tls.Conn)
+			if err := tlsConn.Handshake(); err == nil {
+				serials <- tlsConn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+			}
+			conn.Close()
+		}
+	}()
+
+	client, err := fluent.NewUnbuffered(
+		fluent.WithAddress(l.Addr().String()),
+		fluent.WithTLSFiles(certFile, keyFile, caFile),
+		fluent.WithTLSMinVersion(tls.VersionTLS12),
+		fluent.WithTLSReloadInterval(time.Millisecond),
+		fluent.WithConnectOnStart(true),
+	)
+	if !assert.NoError(t, err, `NewUnbuffered should succeed`) {
+		return
+	}
+	defer client.Close()
+
+	select {
+	case serial := <-serials:
+		if !assert.Equal(t, int64(100), serial, `server should see the original certificate`) {
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf(`timed out waiting for the first connection`)
+		return
+	}
+
+	// rotate the client certificate, and make sure that the next
+	// connection picks it up
+	newTestCert(t, 101, ca, false).writeFiles(t, certFile, keyFile)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	time.Sleep(10 * time.Millisecond)
+
+	client.Close()
+	client.Post("tls.test", map[string]interface{}{"foo": "bar"})
+
+	select {
+	case serial := <-serials:
+		if !assert.Equal(t, int64(101), serial, `server should see the rotated certificate`) {
+			return
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf(`timed out waiting for the second connection`)
+		return
+	}
+
+	t.Run("Config.TLSConfig", func(t *testing.T) {
+		c := fluent.NewConfig()
+		c.TLS.CertFile, c.TLS.KeyFile, c.TLS.CAFile = certFile, keyFile, caFile
+		c.TLS.MinVersion = "1.2"
+
+		conf, err := c.TLSConfig()
+		if !assert.NoError(t, err, `TLSConfig should succeed`) {
+			return
+		}
+		if !assert.Len(t, conf.Certificates, 1, `client certificate should be loaded`) {
+			return
+		}
+		if !assert.NotNil(t, conf.RootCAs, `CA file should be loaded`) {
+			return
+		}
+		if !assert.Equal(t, uint16(tls.VersionTLS12), conf.MinVersion, `min version should be set`) {
+			return
+		}
+	})
+
+	t.Run("WithTLS value", func(t *testing.T) {
+		opt := fluent.WithTLS(tls.Config{ServerName: "example.com"})
+		if !assert.IsType(t, tls.Config{}, opt.Value(), `WithTLS should store a tls.Config value`) {
+			return
+		}
+	})
+
+	t.Run("missing files", func(t *testing.T) {
+		_, err := fluent.NewUnbuffered(fluent.WithTLSFiles(filepath.Join(dir, "nope.pem"), keyFile, ""))
+		if !assert.Error(t, err, `NewUnbuffered should fail`) {
+			return
+		}
+	})
+}
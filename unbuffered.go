@@ -3,10 +3,8 @@ package fluent
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
 	"io"
 	"net"
-	"net/http"
 	"time"
 
 	pdebug "github.com/lestrrat-go/pdebug"
@@ -26,6 +24,10 @@ import (
 //    * fluent.WithTagPrefix
 //
 // Please see their respective documentation for details.
+//
+// If any of the options have values of the wrong type or out of range,
+// or are not applicable to an unbuffered client (e.g. WithBufferLimit),
+// an *OptionError listing all of them is returned.
 func NewUnbuffered(options ...Option) (client *Unbuffered, err error) {
 	if pdebug.Enabled {
 		g := pdebug.Marker("fluent.NewUnbuffered").BindError(&err)
@@ -33,9 +35,10 @@ func NewUnbuffered(options ...Option) (client *Unbuffered, err error) {
 	}
 
 	var c = &Unbuffered{
-		address:         "127.0.0.1:24224",
-		dialTimeout:     3 * time.Second,
-		maxConnAttempts: 64,
+		address:         defaultAddress,
+		clock:           systemClock{},
+		dialTimeout:     defaultDialTimeout,
+		maxConnAttempts: defaultMaxConnAttempts,
 		marshaler:       marshalFunc(msgpackMarshal),
 		network:         "tcp",
 		method:          "forward",
@@ -43,36 +46,92 @@ func NewUnbuffered(options ...Option) (client *Unbuffered, err error) {
 	}
 
 	var connectOnStart bool
+	var tlsOptions []Option
+	var discoveryOptions []Option
+	var limitOptions []Option
+	check := newOptionChecker(`fluent.NewUnbuffered`)
 	for _, opt := range options {
 		switch opt.Name() {
 		case optkeyAddress:
-			c.address = opt.Value().(string)
+			if v, ok := check.nonEmptyString(opt); ok {
+				c.address = v
+			}
 		case optkeyDialTimeout:
-			c.dialTimeout = opt.Value().(time.Duration)
+			if v, ok := check.durationValue(opt); ok {
+				c.dialTimeout = v
+			}
 		case optkeyMarshaler:
-			c.marshaler = opt.Value().(marshaler)
+			if v, ok := check.marshalerValue(opt); ok {
+				c.marshaler = v
+			}
 		case optkeyMaxConnAttempts:
-			c.maxConnAttempts = opt.Value().(uint64)
+			if v, ok := check.uint64Value(opt); ok {
+				c.maxConnAttempts = v
+			}
 		case optkeyNetwork:
-			v := opt.Value().(string)
-			switch v {
-			case "tcp", "unix":
-			default:
-				return nil, errors.Errorf(`invalid network type: %s`, v)
+			if v, ok := check.choice(opt, "tcp", "unix"); ok {
+				c.network = v
 			}
-			c.network = v
 		case optkeySubSecond:
-			c.subsecond = opt.Value().(bool)
+			if v, ok := check.boolValue(opt); ok {
+				c.subsecond = v
+			}
 		case optkeyTagPrefix:
-			c.tagPrefix = opt.Value().(string)
+			if v, ok := check.stringValue(opt); ok {
+				c.tagPrefix = v
+			}
 		case optkeyConnectOnStart:
-			connectOnStart = opt.Value().(bool)
-		case optkeyWithTLS:
-			c.tlsConf = TLSConfig{Enable: true, Conf: opt.Value().(tls.Config)}
+			if v, ok := check.boolValue(opt); ok {
+				connectOnStart = v
+			}
 		case optkeyMethod:
-			c.method = opt.Value().(string)
+			if v, ok := check.choice(opt, "forward", "http"); ok {
+				c.method = v
+			}
+		case optkeyDialer:
+			if v, ok := check.dialerValue(opt); ok {
+				c.dialer = v
+			}
+		case optkeyClock:
+			if v, ok := check.clockValue(opt); ok {
+				c.clock = v
+			}
+		case optkeyFilters:
+			if v, ok := check.filtersValue(opt); ok {
+				c.filters = append(c.filters, v...)
+			}
+		case optkeyRedaction:
+			if v, ok := check.redactionValue(opt); ok {
+				c.filters = append(c.filters, Redact(v...))
+			}
+		case optkeyBuffered:
+			// handled by fluent.New
+			check.boolValue(opt)
+		default:
+			if isTLSOption(opt.Name()) {
+				tlsOptions = append(tlsOptions, opt)
+				continue
+			}
+			if isDiscoveryOption(opt.Name()) {
+				discoveryOptions = append(discoveryOptions, opt)
+				continue
+			}
+			if isLimitOption(opt.Name()) {
+				limitOptions = append(limitOptions, opt)
+				continue
+			}
+			check.reject(opt)
 		}
 	}
+	c.tlsConf = newTLSConfig(check, tlsOptions, c.clock)
+	c.limiter = newLimiter(check, limitOptions, c.clock)
+	if c.method != "http" {
+		c.servers = newServerSet(check, discoveryOptions, c.network, c.address, c.dialTimeout, c.clock)
+	}
+
+	if err := check.result(); err != nil {
+		return nil, err
+	}
 
 	if connectOnStart {
 		if _, err := c.connect(true); err != nil {
@@ -83,13 +142,19 @@ func NewUnbuffered(options ...Option) (client *Unbuffered, err error) {
 	//if method is http marshaler must by raw json
 	if c.method == "http" {
 		c.marshaler = marshalFunc(rawJsonMarshal)
+		c.httpClient = newHTTPClient(c.dialer)
 	}
 
+	c.limiter.start(func(tag string, v interface{}) error {
+		return c.Post(tag, v)
+	})
 	return c, nil
 }
 
 // Close cloes the currenct cached connection, if any
 func (c *Unbuffered) Close() error {
+	c.limiter.stop()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -120,18 +185,22 @@ func (c *Unbuffered) connect(force bool) (net.Conn, error) {
 	}
 
 	ctx := context.Background()
-	conn, err := dial(ctx, c.network, c.address, c.dialTimeout, c.tlsConf)
+	address, serverName := c.servers.pick(ctx, c.address)
+	conn, err := dial(ctx, c.network, address, serverName, c.dialTimeout, c.dialer, c.tlsConf)
 	if err != nil {
+		c.servers.failed(address)
 		return nil, err
 	}
 
 	c.conn = conn
-	go c.connectNotify(ctx)
+	go c.connectNotify(ctx, conn)
 
 	return conn, nil
 }
 
-func (c *Unbuffered) connectNotify(ctx context.Context) {
+// connectNotify watches conn, and closes it when the server does. It
+// gets its own copy of conn, as connect replaces c.conn when reconnecting
+func (c *Unbuffered) connectNotify(ctx context.Context, conn net.Conn) {
 	defer func() {
 		if err := recover(); err != nil {
 			pdebug.Dump(err)
@@ -144,15 +213,16 @@ func (c *Unbuffered) connectNotify(ctx context.Context) {
 			return
 		default:
 		}
-		if c.conn == nil {
-			return
-		}
-		if _, err := c.conn.Read(one); err == io.EOF {
+		// any error (including Close or connect closing the connection)
+		// means this connection is done
+		if _, err := conn.Read(one); err != nil {
 			if pdebug.Enabled {
 				pdebug.Printf("connection closed: error %s connected to %s:%s", err.Error(), c.network, c.address)
 			}
-			c.conn.SetDeadline(time.Now().Add(-time.Second))
-			c.conn.Close()
+			if err == io.EOF {
+				conn.SetDeadline(time.Now().Add(-time.Second))
+				conn.Close()
+			}
 			return
 		}
 	}
@@ -168,6 +238,9 @@ func (c *Unbuffered) serialize(msg *Message) ([]byte, error) {
 
 // Post posts the given structure after encoding it along with the given tag.
 //
+// Records discarded by WithRateLimit, WithSampling or one of the
+// filters given to WithFilters are not reported as errors.
+//
 // If you would like to specify options to `Post()`, you may pass them at the
 // end of the method. Currently you can use the following:
 //
@@ -178,6 +251,9 @@ func (c *Unbuffered) Post(tag string, v interface{}, options ...Option) (err err
 		g := pdebug.Marker("fluent.Unbuffered.Post").BindError(&err)
 		defer g.End()
 	}
+	if !c.limiter.allow(tag) {
+		return nil
+	}
 	if c.method == "http" {
 		return c.HttpPost(tag, v, options...)
 	}
@@ -191,7 +267,12 @@ func (c *Unbuffered) Post(tag string, v interface{}, options ...Option) (err err
 	}
 
 	if t.IsZero() {
-		t = time.Now()
+		t = c.clock.Now()
+	}
+
+	tag, t, v, ok := applyFilters(c.filters, tag, t, v)
+	if !ok {
+		return nil
 	}
 
 	msg := makeMessage(tag, v, t, c.subsecond, false)
@@ -203,6 +284,7 @@ func (c *Unbuffered) Post(tag string, v interface{}, options ...Option) (err err
 	}
 
 	var attempt uint64
+	var lastErr error
 WRITE:
 	attempt++
 	if pdebug.Enabled {
@@ -210,11 +292,15 @@ WRITE:
 	}
 	payload := serialized
 	if attempt > c.maxConnAttempts {
+		if lastErr != nil {
+			return errors.Wrap(lastErr, `exceeded max connection attempts`)
+		}
 		return errors.New(`exceeded max connection attempts`)
 	}
 
 	conn, err := c.connect(attempt > 1)
 	if err != nil {
+		lastErr = err
 		goto WRITE
 	}
 	if pdebug.Enabled {
@@ -228,11 +314,14 @@ WRITE:
 	for len(payload) > 0 {
 		n, err := conn.Write(payload)
 		if err != nil {
-			if err == io.EOF {
-				goto WRITE // Try again
+			// The connection is unusable (e.g. it was closed by the server,
+			// in which case connectNotify may also have closed it), so
+			// write the whole record again over a new one
+			if pdebug.Enabled {
+				pdebug.Printf("failed to write serialized payload: %s", err)
 			}
-
-			return errors.Wrap(err, `failed to write serialized payload`)
+			lastErr = err
+			goto WRITE // Try again
 		}
 		if pdebug.Enabled {
 			pdebug.Printf("Wrote %d bytes", n)
@@ -269,7 +358,12 @@ func (c *Unbuffered) HttpPost(tag string, v interface{}, options ...Option) (err
 	}
 
 	if t.IsZero() {
-		t = time.Now()
+		t = c.clock.Now()
+	}
+
+	tag, t, v, ok := applyFilters(c.filters, tag, t, v)
+	if !ok {
+		return nil
 	}
 
 	msg := makeMessage(tag, v, t, c.subsecond, false)
@@ -294,14 +388,11 @@ func (c *Unbuffered) HttpPost(tag string, v interface{}, options ...Option) (err
 		pdebug.Printf("Posting http message...")
 	}
 
-	client := http.Client{
-		Timeout: 5 * time.Second,
-	}
-
-	_, err = client.Post(address.String(), "application/json", bytes.NewReader(serialized))
+	resp, err := c.httpClient.Post(address.String(), "application/json", bytes.NewReader(serialized))
 	if err != nil {
 		return errors.Wrap(err, `failed to post http request`)
 	}
+	resp.Body.Close()
 
 	return nil
 }
@@ -0,0 +1,332 @@
+package fluent
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// knownOptions lists every option name understood somewhere in this
+// package. It is used to tell apart options that are simply not
+// applicable to a constructor from ones we have never heard of.
+var knownOptions = map[string]struct{}{
+	optkeyAddress:            {},
+	optkeyBuffered:           {},
+	optkeyBufferLimit:        {},
+	optkeyMethod:             {},
+	optkeyContext:            {},
+	optkeyConnectOnStart:     {},
+	optkeyDialTimeout:        {},
+	optkeyMarshaler:          {},
+	optkeyMaxConnAttempts:    {},
+	optkeyNetwork:            {},
+	optkeyPingInterval:       {},
+	optkeyPingResultChan:     {},
+	optkeySubSecond:          {},
+	optkeySyncAppend:         {},
+	optkeyTagPrefix:          {},
+	optkeyTimestamp:          {},
+	optkeyWriteQueueSize:     {},
+	optkeyWriteThreshold:     {},
+	optkeyWithTLS:            {},
+	optkeyMaxHttpPackageSize: {},
+	optkeyHttpPackageGzip:    {},
+	optkeyHttpRetries:        {},
+	optkeyTLSFiles:           {},
+	optkeyTLSServerName:      {},
+	optkeyTLSMinVersion:      {},
+	optkeyTLSReloadInterval:  {},
+	optkeyDialer:             {},
+	optkeySRVLookup:          {},
+	optkeyHostLookup:         {},
+	optkeyResolver:           {},
+	optkeyResolveInterval:    {},
+	optkeyConnMaxLifetime:    {},
+	optkeyConnMaxIdle:        {},
+	optkeyWriterConcurrency:  {},
+	optkeyShardByTag:         {},
+	optkeyChunkSizeLimit:     {},
+	optkeyChunkLimit:         {},
+	optkeyTagBuffer:          {},
+	optkeyMaxRecordAge:       {},
+	optkeyDeadLetter:         {},
+	optkeyRateLimit:          {},
+	optkeySampling:           {},
+	optkeySuppressionSummary: {},
+	optkeyFilters:            {},
+	optkeyRedaction:          {},
+	optkeyFailAfter:          {},
+	optkeyRecheckInterval:    {},
+	optkeyFileFormat:         {},
+	optkeyFileMaxSize:        {},
+	optkeyFileRotateInterval: {},
+	optkeyFileMaxBackups:     {},
+	optkeyFileMaxAge:         {},
+	optkeyConsole:            {},
+	optkeyConsoleJSON:        {},
+	optkeyConsoleColor:       {},
+	optkeyClock:              {},
+}
+
+// optionChecker extracts option values with checked type assertions,
+// and accumulates problems so that a constructor can report all of
+// them at once instead of panicking on the first bad value.
+type optionChecker struct {
+	err OptionError
+}
+
+func newOptionChecker(constructor string) *optionChecker {
+	return &optionChecker{err: OptionError{Constructor: constructor}}
+}
+
+func (c *optionChecker) invalid(opt Option, format string, args ...interface{}) {
+	c.err.Invalid = append(c.err.Invalid, opt.Name()+` (`+fmt.Sprintf(format, args...)+`)`)
+}
+
+// reject records an option that the constructor does not handle
+func (c *optionChecker) reject(opt Option) {
+	if _, ok := knownOptions[opt.Name()]; ok {
+		c.err.Misapplied = append(c.err.Misapplied, opt.Name())
+		return
+	}
+	c.err.Unknown = append(c.err.Unknown, opt.Name())
+}
+
+// result returns an *OptionError if any problems were recorded, nil otherwise
+func (c *optionChecker) result() error {
+	if len(c.err.Invalid) == 0 && len(c.err.Unknown) == 0 && len(c.err.Misapplied) == 0 {
+		return nil
+	}
+	e := c.err
+	return &e
+}
+
+func (c *optionChecker) stringValue(opt Option) (string, bool) {
+	v, ok := opt.Value().(string)
+	if !ok {
+		c.invalid(opt, `expected string, got %T`, opt.Value())
+	}
+	return v, ok
+}
+
+func (c *optionChecker) nonEmptyString(opt Option) (string, bool) {
+	v, ok := c.stringValue(opt)
+	if ok && v == "" {
+		c.invalid(opt, `must not be empty`)
+		return v, false
+	}
+	return v, ok
+}
+
+func (c *optionChecker) choice(opt Option, choices ...string) (string, bool) {
+	v, ok := c.stringValue(opt)
+	if !ok {
+		return v, false
+	}
+	for _, choice := range choices {
+		if v == choice {
+			return v, true
+		}
+	}
+	c.invalid(opt, `must be one of %s, got %q`, strings.Join(choices, `/`), v)
+	return v, false
+}
+
+func (c *optionChecker) boolValue(opt Option) (bool, bool) {
+	v, ok := opt.Value().(bool)
+	if !ok {
+		c.invalid(opt, `expected bool, got %T`, opt.Value())
+	}
+	return v, ok
+}
+
+func (c *optionChecker) intValue(opt Option, min int) (int, bool) {
+	v, ok := opt.Value().(int)
+	if !ok {
+		c.invalid(opt, `expected int, got %T`, opt.Value())
+		return v, false
+	}
+	if v < min {
+		c.invalid(opt, `must be >= %d, got %d`, min, v)
+		return v, false
+	}
+	return v, true
+}
+
+func (c *optionChecker) uint64Value(opt Option) (uint64, bool) {
+	v, ok := opt.Value().(uint64)
+	if !ok {
+		c.invalid(opt, `expected uint64, got %T`, opt.Value())
+	}
+	return v, ok
+}
+
+func (c *optionChecker) sizeValue(opt Option) (int, bool) {
+	v, err := parseSize(opt.Value())
+	if err != nil {
+		c.invalid(opt, `%s`, err)
+		return 0, false
+	}
+	if v <= 0 {
+		c.invalid(opt, `must be positive, got %d`, v)
+		return 0, false
+	}
+	return v, true
+}
+
+func (c *optionChecker) durationValue(opt Option) (time.Duration, bool) {
+	v, ok := opt.Value().(time.Duration)
+	if !ok {
+		c.invalid(opt, `expected time.Duration, got %T`, opt.Value())
+		return v, false
+	}
+	if v <= 0 {
+		c.invalid(opt, `must be positive, got %s`, v)
+		return v, false
+	}
+	return v, true
+}
+
+func (c *optionChecker) marshalerValue(opt Option) (marshaler, bool) {
+	v, ok := opt.Value().(marshaler)
+	if !ok {
+		c.invalid(opt, `expected a marshaler, got %T`, opt.Value())
+	}
+	return v, ok
+}
+
+func (c *optionChecker) dialerValue(opt Option) (DialFunc, bool) {
+	v, ok := opt.Value().(DialFunc)
+	if !ok || v == nil {
+		c.invalid(opt, `expected a non-nil DialFunc, got %T`, opt.Value())
+		return nil, false
+	}
+	return v, true
+}
+
+func (c *optionChecker) clockValue(opt Option) (Clock, bool) {
+	v, ok := opt.Value().(Clock)
+	if !ok || v == nil {
+		c.invalid(opt, `expected a non-nil fluent.Clock, got %T`, opt.Value())
+		return nil, false
+	}
+	return v, true
+}
+
+var sizeUnits = map[string]int{
+	"":    1,
+	"b":   1,
+	"k":   1024,
+	"kb":  1024,
+	"kib": 1024,
+	"m":   1024 * 1024,
+	"mb":  1024 * 1024,
+	"mib": 1024 * 1024,
+	"g":   1024 * 1024 * 1024,
+	"gb":  1024 * 1024 * 1024,
+	"gib": 1024 * 1024 * 1024,
+}
+
+// parseSize converts integers and human readable strings such as
+// "512", "64KB" or "8MiB" into a number of bytes. As with fluentd,
+// the "K", "M" and "G" units are powers of 1024.
+func parseSize(v interface{}) (int, error) {
+	switch v := v.(type) {
+	case int:
+		return v, nil
+	case int32:
+		return int(v), nil
+	case int64:
+		return int(v), nil
+	case uint:
+		return int(v), nil
+	case uint32:
+		return int(v), nil
+	case uint64:
+		return int(v), nil
+	case string:
+		s := strings.ToLower(strings.TrimSpace(v))
+		i := 0
+		for i < len(s) && (s[i] >= '0' && s[i] <= '9' || s[i] == '.') {
+			i++
+		}
+		unit, ok := sizeUnits[strings.TrimSpace(s[i:])]
+		if !ok || i == 0 {
+			return 0, errors.Errorf(`invalid size %q`, v)
+		}
+		n, err := strconv.ParseFloat(s[:i], 64)
+		if err != nil {
+			return 0, errors.Errorf(`invalid size %q`, v)
+		}
+		return int(n * float64(unit)), nil
+	}
+	return 0, errors.Errorf(`expected an integer or a size string such as "8MB", got %T`, v)
+}
+
+func (c *optionChecker) filtersValue(opt Option) ([]Filter, bool) {
+	filters, ok := opt.Value().([]Filter)
+	if !ok {
+		c.invalid(opt, `expected []fluent.Filter, got %T`, opt.Value())
+		return nil, false
+	}
+	for i, f := range filters {
+		if f == nil {
+			c.invalid(opt, `filter #%d is nil`, i+1)
+			return nil, false
+		}
+	}
+	return filters, true
+}
+
+func (c *optionChecker) redactionValue(opt Option) ([]RedactionRule, bool) {
+	rules, ok := opt.Value().([]RedactionRule)
+	if !ok {
+		c.invalid(opt, `expected []fluent.RedactionRule, got %T`, opt.Value())
+		return nil, false
+	}
+	for i, rule := range rules {
+		if _, err := compileTagMatcher(rule.Tags); err != nil {
+			c.invalid(opt, `rule #%d: %s`, i+1, err)
+			return nil, false
+		}
+		switch rule.Action {
+		case RedactMask, RedactHash:
+		default:
+			c.invalid(opt, `rule #%d: unknown action %d`, i+1, rule.Action)
+			return nil, false
+		}
+	}
+	return rules, true
+}
+
+func (c *optionChecker) tagBufferValue(opt Option) (TagBuffer, *regexp.Regexp, bool) {
+	b, ok := opt.Value().(TagBuffer)
+	if !ok {
+		c.invalid(opt, `expected fluent.TagBuffer, got %T`, opt.Value())
+		return b, nil, false
+	}
+	re, err := compileTagPattern(b.Pattern)
+	if err != nil {
+		c.invalid(opt, `%s`, err)
+		return b, nil, false
+	}
+	if b.Limit < 0 {
+		c.invalid(opt, `limit must not be negative, got %d`, b.Limit)
+		return b, nil, false
+	}
+	if b.MaxAge < 0 {
+		c.invalid(opt, `max age must not be negative, got %s`, b.MaxAge)
+		return b, nil, false
+	}
+	switch b.Overflow {
+	case OverflowReject, OverflowDropOldest:
+	default:
+		c.invalid(opt, `unknown overflow policy %d`, b.Overflow)
+		return b, nil, false
+	}
+	return b, re, true
+}
@@ -0,0 +1,155 @@
+package fluent_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	fluent "github.com/Edwardsj/fluent-client"
+	msgpack "github.com/lestrrat-go/msgpack"
+	"github.com/stretchr/testify/assert"
+)
+
+type receivedRecord struct {
+	conn int
+	tag  string
+	seq  int
+}
+
+// multiConnServer accepts any number of concurrent connections, and
+// reports which connection each message was received on
+type multiConnServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	records  []receivedRecord
+}
+
+func newMultiConnServer(t *testing.T) *multiConnServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err, `net.Listen should succeed`) {
+		t.FailNow()
+	}
+	s := &multiConnServer{listener: l}
+	go func() {
+		for id := 0; ; id++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(id, conn)
+		}
+	}()
+	return s
+}
+
+func (s *multiConnServer) serve(id int, conn net.Conn) {
+	defer conn.Close()
+	dec := msgpack.NewDecoder(conn)
+	for {
+		var msg fluent.Message
+		if err := dec.Decode(&msg); err != nil {
+			return
+		}
+		record, _ := msg.Record.(map[string]interface{})
+		seq, _ := strconv.Atoi(fmt.Sprint(record["seq"]))
+		s.mu.Lock()
+		s.records = append(s.records, receivedRecord{conn: id, tag: msg.Tag, seq: seq})
+		s.mu.Unlock()
+	}
+}
+
+// Records waits until n records have been received (or a timeout
+// passes), and returns everything that was received
+func (s *multiConnServer) Records(n int) []receivedRecord {
+	defer s.listener.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		records := s.records
+		s.mu.Unlock()
+		if len(records) >= n || time.Now().After(deadline) {
+			return records
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWriterConcurrency(t *testing.T) {
+	tags := []string{"app.a", "app.b", "app.c", "app.d", "app.e", "app.f", "app.g", "app.h"}
+	const perTag = 25
+
+	post := func(t *testing.T, s *multiConnServer, options ...fluent.Option) bool {
+		options = append(options,
+			fluent.WithAddress(s.listener.Addr().String()),
+			fluent.WithWriterConcurrency(4),
+			fluent.WithWriteThreshold(0),
+		)
+		client, err := fluent.New(options...)
+		if !assert.NoError(t, err, `fluent.New should succeed`) {
+			return false
+		}
+		for i := 0; i < perTag; i++ {
+			for _, tag := range tags {
+				if !assert.NoError(t, client.Post(tag, map[string]interface{}{"seq": strconv.Itoa(i)}), `Post should succeed`) {
+					return false
+				}
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return assert.NoError(t, client.Shutdown(ctx), `Shutdown should succeed`)
+	}
+
+	t.Run("round robin", func(t *testing.T) {
+		s := newMultiConnServer(t)
+		if !post(t, s) {
+			return
+		}
+		records := s.Records(perTag * len(tags))
+		if !assert.Len(t, records, perTag*len(tags), `server should receive every message`) {
+			return
+		}
+		conns := map[int]struct{}{}
+		for _, r := range records {
+			conns[r.conn] = struct{}{}
+		}
+		if !assert.Len(t, conns, 4, `messages should be spread across 4 connections`) {
+			return
+		}
+	})
+
+	t.Run("shard by tag", func(t *testing.T) {
+		s := newMultiConnServer(t)
+		if !post(t, s, fluent.WithShardByTag(true)) {
+			return
+		}
+		records := s.Records(perTag * len(tags))
+		if !assert.Len(t, records, perTag*len(tags), `server should receive every message`) {
+			return
+		}
+
+		conns := map[int]struct{}{}
+		tagConn := map[string]int{}
+		lastSeq := map[string]int{}
+		for _, r := range records {
+			conns[r.conn] = struct{}{}
+			if c, ok := tagConn[r.tag]; ok {
+				if !assert.Equal(t, c, r.conn, `messages for %s should use a single connection`, r.tag) {
+					return
+				}
+				if !assert.Equal(t, lastSeq[r.tag]+1, r.seq, `messages for %s should arrive in order`, r.tag) {
+					return
+				}
+			}
+			tagConn[r.tag] = r.conn
+			lastSeq[r.tag] = r.seq
+		}
+		if !assert.True(t, len(conns) > 1, `messages should be spread across connections`) {
+			return
+		}
+	})
+}